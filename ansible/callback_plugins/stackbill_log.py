@@ -2,53 +2,62 @@
 Custom Ansible stdout callback plugin for StackBill Deployer.
 
 Formats Ansible output to match the log format expected by the
-StackBill frontend (app.js) and Go backend (detectStage).
+StackBill frontend (app.js).
 
 Output format:
   - Stage headers: bordered lines with ║ characters for frontend phase-header detection
   - Task results: [INFO], [WARN], [ERROR] prefixed lines
   - Debug messages: forwarded as [INFO] lines (used for credential/summary output)
+
+Structured events:
+  When SB_EVENT_FD is set, one JSON object per line is also written to that
+  file descriptor (role_start, role_end, task_ok, task_changed, task_failed,
+  unreachable, stats). The Go backend (deployer.Event) drives stage
+  transitions from these instead of matching log text. Values of secret-looking
+  facts set during the run (generated passwords, API keys) are sent as secret
+  events so the backend can mask them in the log. After each secret event the
+  plugin waits for a line on SB_EVENT_ACK_FD, so the backend has registered
+  the value before any further output can contain it.
+
+Stage headers come from ../stages.yml, the manifest shared with the Go backend.
 """
 
 from __future__ import absolute_import, division, print_function
 
 __metaclass__ = type
 
+import os
 import sys
 import json
+import time
+from datetime import datetime, timezone
+
+import yaml
 
 from ansible.plugins.callback import CallbackBase
 
 
-# Maps Ansible role names to the stage header text that must match
-# the MatchKey (or Name fallback) in models.BuildStages()
-ROLE_STAGE_MAP = {
-    "check_requirements": "Checking System Requirements",
-    "k3s": "Installing K3s",
-    "helm": "Installing Helm",
-    "istio": "Installing Istio",
-    "certbot": "Installing Certbot",
-    "letsencrypt_cert": "Generating Let's Encrypt SSL Certificate",
-    "certificate_renewal": "Setting up Automatic Certificate Renewal",
-    "mariadb": "Installing MariaDB",
-    "mongodb": "Installing MongoDB",
-    "rabbitmq": "Installing RabbitMQ",
-    "nfs": "Setting up NFS Storage",
-    "k8s_namespace": "Setting up Kubernetes Namespace",
-    "ecr_credentials": "Setting up Deployment Credentials",
-    "tls_secret": "Setting up TLS Secret",
-    "deploy_stackbill": "Deploying StackBill",
-    "istio_gateway": "Setting up Istio Gateway",
-    "wait_for_pods": "Waiting for StackBill Pods",
-    "podman": "Installing Podman",
-    "cloudstack_simulator": "Deploying CloudStack Simulator",
-    "cloudstack_rabbitmq": "Configuring CloudStack RabbitMQ",
-    "cloudstack_user": "Creating CloudStack Admin User for StackBill",
-    "save_credentials": "Saving Credentials",
-}
+STAGE_MANIFEST = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "stages.yml")
+
+
+def _load_role_stage_map(path):
+    """Map Ansible role names to the stage header text from the stage manifest."""
+    with open(path) as f:
+        manifest = yaml.safe_load(f) or {}
+    return {
+        stage["role"]: stage.get("header") or stage["name"]
+        for stage in manifest.get("stages", [])
+    }
+
+
+# Maps Ansible role names to the stage header text shown in the log output
+ROLE_STAGE_MAP = _load_role_stage_map(STAGE_MANIFEST)
 
 BORDER = "═" * 64
 
+# Facts whose names contain one of these are reported as secret events
+SECRET_FACT_MARKERS = ("password", "secret", "token", "api_key", "sessionkey", "privkey", "ssl_key")
+
 
 def _emit(msg):
     """Write a line to stdout and flush immediately for real-time streaming."""
@@ -56,6 +65,28 @@ def _emit(msg):
     sys.stdout.flush()
 
 
+def _open_event_stream():
+    """Open the structured event fd passed by the Go backend, if any."""
+    fd = os.environ.get("SB_EVENT_FD")
+    if not fd:
+        return None
+    try:
+        return os.fdopen(int(fd), "w", buffering=1)
+    except (OSError, ValueError):
+        return None
+
+
+def _open_ack_stream():
+    """Open the fd on which the Go backend acknowledges secret events, if any."""
+    fd = os.environ.get("SB_EVENT_ACK_FD")
+    if not fd:
+        return None
+    try:
+        return os.fdopen(int(fd), "r", buffering=1)
+    except (OSError, ValueError):
+        return None
+
+
 def _get_role_name(task):
     """Extract the role name from a task, if any."""
     if task._role:
@@ -71,24 +102,74 @@ class CallbackModule(CallbackBase):
     def __init__(self):
         super(CallbackModule, self).__init__()
         self._current_role = None
+        self._role_started = None
+        self._task_started = None
+        self._events = _open_event_stream()
+        self._acks = _open_ack_stream() if self._events is not None else None
+
+    def _event(self, event_type, **fields):
+        """Write a structured JSON event to the event fd (no-op when not configured)."""
+        if self._events is None:
+            return
+        fields["type"] = event_type
+        fields["time"] = datetime.now(timezone.utc).isoformat()
+        try:
+            self._events.write(json.dumps(fields) + "\n")
+            self._events.flush()
+        except (OSError, ValueError):
+            self._events = None
+            return
+        if event_type == "secret" and self._acks is not None:
+            # Block until the backend masks the value; EOF means it stopped listening
+            try:
+                if not self._acks.readline():
+                    self._acks = None
+            except (OSError, ValueError):
+                self._acks = None
+
+    def _task_event(self, event_type, result, **fields):
+        """Emit a task-level event with role, host and duration."""
+        if self._task_started is not None:
+            fields["duration"] = round(time.time() - self._task_started, 3)
+        self._event(
+            event_type,
+            role=_get_role_name(result._task),
+            task=result._task.get_name(),
+            host=result._host.get_name(),
+            **fields
+        )
+
+    def _end_role(self):
+        """Emit role_end for the role that just finished."""
+        if self._current_role is None:
+            return
+        self._event(
+            "role_end",
+            role=self._current_role,
+            duration=round(time.time() - self._role_started, 3),
+        )
 
     def _emit_stage_header(self, role_name):
-        """Emit bordered stage header matching frontend regex and backend detectStage."""
+        """Emit bordered stage header matching the frontend phase-header regex."""
         stage_name = ROLE_STAGE_MAP.get(role_name)
         if not stage_name:
             return
         # Border line (filtered by frontend line 543: pure box-drawing chars)
         _emit(BORDER)
-        # Stage name line (matched by frontend stageMatch regex and backend detectStage)
+        # Stage name line (matched by frontend stageMatch regex)
         _emit("║  {}  ║".format(stage_name))
         _emit(BORDER)
 
     def _check_role_change(self, task):
-        """Detect role transitions and emit stage headers."""
+        """Detect role transitions and emit stage headers and role events."""
+        self._task_started = time.time()
         role_name = _get_role_name(task)
         if role_name and role_name != self._current_role:
+            self._end_role()
             self._current_role = role_name
+            self._role_started = time.time()
             self._emit_stage_header(role_name)
+            self._event("role_start", role=role_name)
 
     # -- Playbook events (suppressed to avoid Ansible noise) --
 
@@ -103,8 +184,18 @@ class CallbackModule(CallbackBase):
 
     # -- Runner events --
 
+    def _report_secrets(self, result):
+        """Announce secret-looking facts so the backend masks them before logging."""
+        if result._task.action not in ("ansible.builtin.set_fact", "set_fact"):
+            return
+        for name, value in result._result.get("ansible_facts", {}).items():
+            if isinstance(value, str) and value and any(m in name for m in SECRET_FACT_MARKERS):
+                self._event("secret", value=value)
+
     def v2_runner_on_ok(self, result, **kwargs):
         task_name = result._task.get_name()
+        self._report_secrets(result)
+        self._task_event("task_changed" if result.is_changed() else "task_ok", result)
 
         # Forward debug messages as [INFO] lines
         if result._task.action in ("ansible.builtin.debug", "debug"):
@@ -142,6 +233,7 @@ class CallbackModule(CallbackBase):
         msg = result._result.get("msg", "")
         stderr = result._result.get("stderr", "")
         error_detail = msg or stderr or "unknown error"
+        self._task_event("task_failed", result, msg=str(error_detail), ignore_errors=bool(ignore_errors))
 
         if ignore_errors:
             _emit("[WARN] {} ... FAILED (ignored): {}".format(task_name, error_detail))
@@ -154,6 +246,7 @@ class CallbackModule(CallbackBase):
 
     def v2_runner_on_unreachable(self, result, **kwargs):
         msg = result._result.get("msg", "")
+        self._task_event("unreachable", result, msg=str(msg))
         _emit("[ERROR] Target unreachable: {}".format(msg))
 
     # -- Stats (suppressed) --
@@ -161,8 +254,23 @@ class CallbackModule(CallbackBase):
     def v2_playbook_on_stats(self, stats):
         # Emit final summary
         hosts = sorted(stats.processed.keys())
+        failed = any(
+            stats.summarize(h)["failures"] > 0 or stats.summarize(h)["unreachable"] > 0
+            for h in hosts
+        )
+        # The last role only ends cleanly if nothing failed
+        if not failed:
+            self._end_role()
         for h in hosts:
             s = stats.summarize(h)
+            self._event(
+                "stats",
+                host=h,
+                ok=s["ok"],
+                changed=s["changed"],
+                failures=s["failures"],
+                unreachable=s["unreachable"],
+            )
             if s["failures"] > 0 or s["unreachable"] > 0:
                 _emit("[ERROR] Deployment failed: {} failures, {} unreachable".format(
                     s["failures"], s["unreachable"]))
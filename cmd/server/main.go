@@ -1,14 +1,23 @@
 package server
 
 import (
+	"context"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"time"
 
+	"stackbill-deployer/internal/audit"
+	"stackbill-deployer/internal/auth"
 	"stackbill-deployer/internal/config"
+	"stackbill-deployer/internal/credstore"
 	"stackbill-deployer/internal/handlers"
+	"stackbill-deployer/internal/logstore"
+	"stackbill-deployer/internal/models"
+	"stackbill-deployer/internal/stages"
+	"stackbill-deployer/internal/store"
 
 	"github.com/gorilla/mux"
 )
@@ -29,10 +38,81 @@ func Run() {
 		log.Fatalf("Failed to parse templates: %v", err)
 	}
 
+	// Load the stage manifest and make sure the playbook agrees with it
+	ansibleDir := filepath.Join(root, cfg.AnsibleDir)
+	manifest, err := stages.Load(filepath.Join(ansibleDir, "stages.yml"))
+	if err != nil {
+		log.Fatalf("Failed to load stage manifest: %v", err)
+	}
+	if err := manifest.CheckPlaybook(filepath.Join(ansibleDir, "playbook.yml"), models.DeployTypeInstall, models.DeployTypeUpgrade); err != nil {
+		log.Fatalf("Stage manifest check failed: %v", err)
+	}
+	if err := manifest.CheckPlaybook(filepath.Join(ansibleDir, "uninstall.yml"), models.DeployTypeUninstall); err != nil {
+		log.Fatalf("Stage manifest check failed: %v", err)
+	}
+
+	// Open the deployment and log stores, importing the legacy state.json on first start
+	st, err := store.OpenBolt(filepath.Join(cfg.DataDir, "deployer.db"))
+	if err != nil {
+		log.Fatalf("Failed to open deployment store: %v", err)
+	}
+	defer st.Close()
+	logs, err := logstore.Open(filepath.Join(cfg.DataDir, "logs"))
+	if err != nil {
+		log.Fatalf("Failed to open log store: %v", err)
+	}
+	if err := store.MigrateStateFile(st, logs, filepath.Join(cfg.DataDir, "state.json")); err != nil {
+		log.Fatalf("Failed to migrate state file: %v", err)
+	}
+	creds, err := credstore.Open(filepath.Join(cfg.DataDir, "credentials"), cfg.CredentialsKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to open credentials store: %v", err)
+	}
+	tokens, err := auth.OpenTokenStore(filepath.Join(cfg.DataDir, "tokens.json"))
+	if err != nil {
+		log.Fatalf("Failed to open token store: %v", err)
+	}
+	auditLog, err := audit.Open(filepath.Join(cfg.DataDir, "audit.jsonl"))
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	// Single sign-on is optional; the provider must be reachable at startup
+	var oidc *auth.OIDC
+	if cfg.OIDC.Enabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		oidc, err = auth.NewOIDC(ctx, cfg.OIDC)
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to set up SSO: %v", err)
+		}
+		log.Printf("SSO enabled with %s", cfg.OIDC.Issuer)
+	}
+
 	// Create handlers
-	apiHandler := handlers.NewAPIHandler(cfg)
+	apiHandler := handlers.NewAPIHandler(cfg, manifest, st, logs, creds, tokens, oidc, auditLog)
+
+	r := newRouter(apiHandler, tmpl, root, oidc)
+
+	addr := ":" + cfg.Port
+
+	log.Println("=========================================")
+	log.Printf("  StackBill Deployer running on port %s", cfg.Port)
+	log.Printf("  Admin token: %s", cfg.AuthTokenSource)
+	log.Println("=========================================")
 
-	// Router
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		log.Println("  TLS: enabled")
+		log.Fatal(http.ListenAndServeTLS(addr, cfg.TLSCert, cfg.TLSKey, r))
+	} else {
+		log.Fatal(http.ListenAndServe(addr, r))
+	}
+}
+
+// newRouter builds the routes of the web UI and API. oidc is nil when single
+// sign-on is not configured.
+func newRouter(apiHandler *handlers.APIHandler, tmpl *template.Template, root string, oidc *auth.OIDC) *mux.Router {
 	r := mux.NewRouter()
 
 	// Security headers on all routes
@@ -44,31 +124,44 @@ func Run() {
 
 	// Page routes (no auth — the HTML shell is public, API is protected)
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if err := tmpl.ExecuteTemplate(w, "index.html", nil); err != nil {
+		if err := tmpl.ExecuteTemplate(w, "index.html", map[string]interface{}{"OIDCEnabled": oidc != nil}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}).Methods("GET")
 
-	// API routes (auth required via bearer token)
+	// Login and, when configured, SSO are the only auth routes reachable without credentials
+	audited := apiHandler.Audit
+	r.HandleFunc("/api/login", audited("login", apiHandler.Login)).Methods("POST")
+	if oidc != nil {
+		// The SSO flow ends in a session cookie accepted by the API routes below
+		r.HandleFunc("/auth/oidc/login", apiHandler.OIDCLogin).Methods("GET")
+		r.HandleFunc("/auth/oidc/callback", audited("sso_login", apiHandler.OIDCCallback)).Methods("GET")
+	}
+
+	// API routes (auth required via bearer token or session cookie; each route needs a minimum scope).
+	// Mutating and sensitive routes are recorded in the audit log.
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(apiHandler.AuthMiddleware)
-	api.HandleFunc("/deploy", apiHandler.Deploy).Methods("POST")
-	api.HandleFunc("/deployments", apiHandler.ListDeployments).Methods("GET")
-	api.HandleFunc("/deployments/{id}", apiHandler.GetDeployment).Methods("GET")
-	api.HandleFunc("/deployments/{id}/stream", apiHandler.StreamSSE).Methods("GET")
-	api.HandleFunc("/deployments/{id}/log", apiHandler.DownloadLog).Methods("GET")
-
-	addr := ":" + cfg.Port
-
-	log.Println("=========================================")
-	log.Printf("  StackBill Deployer running on port %s", cfg.Port)
-	log.Printf("  Auth Token: %s", cfg.AuthToken)
-	log.Println("=========================================")
-
-	if cfg.TLSCert != "" && cfg.TLSKey != "" {
-		log.Println("  TLS: enabled")
-		log.Fatal(http.ListenAndServeTLS(addr, cfg.TLSCert, cfg.TLSKey, r))
-	} else {
-		log.Fatal(http.ListenAndServe(addr, r))
-	}
+	read := func(h http.HandlerFunc) http.HandlerFunc { return apiHandler.RequireScope(auth.ScopeRead, h) }
+	deploy := func(h http.HandlerFunc) http.HandlerFunc { return apiHandler.RequireScope(auth.ScopeDeploy, h) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return apiHandler.RequireScope(auth.ScopeAdmin, h) }
+	limited := apiHandler.RateLimit // Per-client limit on requests that start work on servers
+	api.HandleFunc("/session", apiHandler.Session).Methods("GET")
+	api.HandleFunc("/logout", audited("logout", apiHandler.Logout)).Methods("POST")
+	api.HandleFunc("/deploy", audited("deploy", deploy(limited(apiHandler.Deploy)))).Methods("POST")
+	api.HandleFunc("/preflight", audited("preflight", deploy(limited(apiHandler.Preflight)))).Methods("POST")
+	api.HandleFunc("/deployments", read(apiHandler.ListDeployments)).Methods("GET")
+	api.HandleFunc("/deployments/{id}", audited("view", read(apiHandler.GetDeployment))).Methods("GET")
+	api.HandleFunc("/deployments/{id}/resume", audited("resume", deploy(limited(apiHandler.ResumeDeployment)))).Methods("POST")
+	api.HandleFunc("/deployments/{id}/cancel", audited("cancel", deploy(apiHandler.CancelDeployment))).Methods("POST")
+	api.HandleFunc("/deployments/{id}/uninstall", audited("uninstall", deploy(limited(apiHandler.UninstallDeployment)))).Methods("POST")
+	api.HandleFunc("/deployments/{id}/viewers", audited("share", deploy(apiHandler.ShareDeployment))).Methods("PUT")
+	api.HandleFunc("/deployments/{id}/stream", audited("view", read(apiHandler.StreamSSE))).Methods("GET")
+	api.HandleFunc("/deployments/{id}/log", audited("log_download", read(apiHandler.DownloadLog))).Methods("GET")
+	api.HandleFunc("/deployments/{id}/credentials", audited("credentials_read", admin(apiHandler.GetCredentials))).Methods("GET")
+	api.HandleFunc("/tokens", admin(apiHandler.ListTokens)).Methods("GET")
+	api.HandleFunc("/tokens", audited("token_create", admin(apiHandler.CreateToken))).Methods("POST")
+	api.HandleFunc("/tokens/{id}", audited("token_revoke", admin(apiHandler.RevokeToken))).Methods("DELETE")
+	api.HandleFunc("/audit", audited("audit_read", admin(apiHandler.GetAudit))).Methods("GET")
+	return r
 }
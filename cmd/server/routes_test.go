@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"stackbill-deployer/internal/audit"
+	"stackbill-deployer/internal/auth"
+	"stackbill-deployer/internal/config"
+	"stackbill-deployer/internal/credstore"
+	"stackbill-deployer/internal/handlers"
+	"stackbill-deployer/internal/logstore"
+	"stackbill-deployer/internal/stages"
+	"stackbill-deployer/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	testAdminToken = "test-admin-token"
+	testCredsToken = "test-credentials-token"
+)
+
+// newTestServer serves the real route table backed by stores in a temp dir.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	root := getProjectRoot()
+	dir := t.TempDir()
+
+	cfg := &config.Config{
+		AnsibleDir:         "ansible",
+		AuthToken:          testAdminToken,
+		DataDir:            dir,
+		Workers:            1,
+		MaxQueued:          1,
+		SessionTTL:         time.Hour,
+		CredentialsToken:   testCredsToken,
+		CredentialsKeyFile: filepath.Join(dir, "credentials.key"),
+		RateLimit: config.RateLimitConfig{
+			DeployPerMinute: 6000,
+			DeployBurst:     1000,
+			AuthFailures:    1000,
+			AuthPerMinute:   6000,
+			AuthLockout:     time.Minute,
+		},
+	}
+	manifest, err := stages.Load(filepath.Join(root, "ansible", "stages.yml"))
+	if err != nil {
+		t.Fatalf("loading stage manifest: %v", err)
+	}
+	st, err := store.OpenBolt(filepath.Join(dir, "deployer.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	logs, err := logstore.Open(filepath.Join(dir, "logs"))
+	if err != nil {
+		t.Fatalf("opening log store: %v", err)
+	}
+	creds, err := credstore.Open(filepath.Join(dir, "credentials"), cfg.CredentialsKeyFile)
+	if err != nil {
+		t.Fatalf("opening credentials store: %v", err)
+	}
+	tokens, err := auth.OpenTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatalf("opening token store: %v", err)
+	}
+	auditLog, err := audit.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("opening audit log: %v", err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	tmpl, err := template.ParseGlob(filepath.Join(root, "web", "templates", "*.html"))
+	if err != nil {
+		t.Fatalf("parsing templates: %v", err)
+	}
+
+	apiHandler := handlers.NewAPIHandler(cfg, manifest, st, logs, creds, tokens, nil, auditLog)
+	srv := httptest.NewServer(newRouter(apiHandler, tmpl, root, nil))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, bearer, body string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// createToken creates a named token through the API and returns its ID and secret.
+func createToken(t *testing.T, srv *httptest.Server, name string, scope auth.Scope) (string, string) {
+	t.Helper()
+	body := `{"name": "` + name + `", "scope": "` + string(scope) + `"}`
+	req, _ := http.NewRequest("POST", srv.URL+"/api/tokens", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating token %q: status %d", name, resp.StatusCode)
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	return created.ID, created.Token
+}
+
+func TestRouteScopes(t *testing.T) {
+	srv := newTestServer(t)
+	secrets := map[auth.Scope]string{}
+	for _, scope := range []auth.Scope{auth.ScopeRead, auth.ScopeDeploy, auth.ScopeAdmin} {
+		_, secrets[scope] = createToken(t, srv, string(scope)+"-user", scope)
+	}
+
+	// The handlers behind the routes reject these requests (no such
+	// deployment, empty body, ...), but only after the scope check.
+	const dep = "/api/deployments/20260101-000000-deadbeef"
+	credsHeader := http.Header{"X-Credentials-Token": {testCredsToken}}
+	routes := []struct {
+		method, path, body string
+		header             http.Header
+		scope              auth.Scope
+	}{
+		{"GET", "/api/deployments", "", nil, auth.ScopeRead},
+		{"GET", dep, "", nil, auth.ScopeRead},
+		{"GET", dep + "/stream", "", nil, auth.ScopeRead},
+		{"GET", dep + "/log", "", nil, auth.ScopeRead},
+		{"POST", "/api/deploy", "{}", nil, auth.ScopeDeploy},
+		{"POST", "/api/preflight", "{}", nil, auth.ScopeDeploy},
+		{"POST", dep + "/resume", "{}", nil, auth.ScopeDeploy},
+		{"POST", dep + "/cancel", "", nil, auth.ScopeDeploy},
+		{"POST", dep + "/uninstall", "{}", nil, auth.ScopeDeploy},
+		{"PUT", dep + "/viewers", `{"viewers": []}`, nil, auth.ScopeDeploy},
+		{"GET", dep + "/credentials", "", credsHeader, auth.ScopeAdmin},
+		{"GET", "/api/tokens", "", nil, auth.ScopeAdmin},
+		{"POST", "/api/tokens", "{}", nil, auth.ScopeAdmin},
+		{"DELETE", "/api/tokens/0123456789abcdef", "", nil, auth.ScopeAdmin},
+		{"GET", "/api/audit", "", nil, auth.ScopeAdmin},
+	}
+	for _, route := range routes {
+		for scope, secret := range secrets {
+			resp := do(t, srv, route.method, route.path, secret, route.body, route.header)
+			if scope.Allows(route.scope) {
+				if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+					t.Errorf("%s %s with %s token: status %d, want it allowed", route.method, route.path, scope, resp.StatusCode)
+				}
+			} else if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s with %s token: status %d, want 403", route.method, route.path, scope, resp.StatusCode)
+			}
+		}
+		if resp := do(t, srv, route.method, route.path, "", route.body, route.header); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token: status %d, want 401", route.method, route.path, resp.StatusCode)
+		}
+	}
+}
+
+// TestRouteTableCovered fails when an API route is added without a scope
+// check in TestRouteScopes.
+func TestRouteTableCovered(t *testing.T) {
+	r := newRouter(nil, nil, getProjectRoot(), nil)
+	open := map[string]bool{"/api/login": true, "/api/session": true, "/api/logout": true}
+	tested := map[string]bool{
+		"/api/deploy": true, "/api/preflight": true, "/api/deployments": true,
+		"/api/deployments/{id}": true, "/api/deployments/{id}/resume": true,
+		"/api/deployments/{id}/cancel": true, "/api/deployments/{id}/uninstall": true,
+		"/api/deployments/{id}/viewers": true, "/api/deployments/{id}/stream": true,
+		"/api/deployments/{id}/log": true, "/api/deployments/{id}/credentials": true,
+		"/api/tokens": true, "/api/tokens/{id}": true, "/api/audit": true,
+	}
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		if !open[path] && !tested[path] {
+			t.Errorf("route %s has no scope test", path)
+		}
+		return nil
+	})
+}
+
+func TestRevokedTokenRejectedImmediately(t *testing.T) {
+	srv := newTestServer(t)
+	id, secret := createToken(t, srv, "alice", auth.ScopeDeploy)
+
+	// Log in with the token to get a cookie session as well
+	resp, err := srv.Client().Post(srv.URL+"/api/login", "application/json", strings.NewReader(`{"token": "`+secret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "sb_session" {
+			session = c
+		}
+	}
+	if resp.StatusCode != http.StatusOK || session == nil {
+		t.Fatalf("login: status %d, cookie %v", resp.StatusCode, session)
+	}
+	withCookie := func() int {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/deployments", nil)
+		req.AddCookie(session)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := do(t, srv, "GET", "/api/deployments", secret, "", nil).StatusCode; status != http.StatusOK {
+		t.Fatalf("bearer before revoke: status %d", status)
+	}
+	if status := withCookie(); status != http.StatusOK {
+		t.Fatalf("session before revoke: status %d", status)
+	}
+
+	if status := do(t, srv, "DELETE", "/api/tokens/"+id, testAdminToken, "", nil).StatusCode; status != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", status)
+	}
+
+	if status := do(t, srv, "GET", "/api/deployments", secret, "", nil).StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("bearer after revoke: status %d, want 401", status)
+	}
+	if status := withCookie(); status != http.StatusUnauthorized {
+		t.Errorf("session after revoke: status %d, want 401", status)
+	}
+}
+
+func TestDeploymentViewsAudited(t *testing.T) {
+	srv := newTestServer(t)
+	_, secret := createToken(t, srv, "viewer", auth.ScopeRead)
+	const dep = "/api/deployments/20260101-000000-deadbeef"
+	for _, path := range []string{dep, dep + "/stream", dep + "/log"} {
+		do(t, srv, "GET", path, secret, "", nil)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/audit?actor=viewer", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var entries []audit.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		if e.DeploymentID != "20260101-000000-deadbeef" {
+			t.Errorf("entry %+v has the wrong deployment", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "view,view,log_download" {
+		t.Errorf("audited actions = %s, want view,view,log_download", got)
+	}
+}
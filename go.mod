@@ -2,4 +2,16 @@ module stackbill-deployer
 
 go 1.24.0
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/coreos/go-oidc/v3 v3.17.0
+	github.com/gorilla/mux v1.8.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.45.0
+	golang.org/x/oauth2 v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-jose/go-jose/v4 v4.1.3 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied" // Authentication or authorization failed
+	OutcomeFailed  = "failed" // Rejected as invalid, or failed while running
+)
+
+// Entry is one audited action.
+type Entry struct {
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"` // Token or SSO name; empty when unauthenticated
+	SourceIP     string    `json:"source_ip,omitempty"`
+	Action       string    `json:"action"`
+	DeploymentID string    `json:"deployment_id,omitempty"`
+	Server       string    `json:"server,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Status       int       `json:"status,omitempty"` // HTTP status of the request
+	Detail       string    `json:"detail,omitempty"`
+}
+
+// Filter selects entries; zero fields match everything.
+type Filter struct {
+	Since        time.Time
+	Until        time.Time
+	Actor        string
+	Action       string
+	DeploymentID string
+}
+
+func (f Filter) match(e Entry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.DeploymentID == "" || e.DeploymentID == f.DeploymentID)
+}
+
+// Log appends entries as JSON lines to a file that is only ever appended to.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// Open opens (or creates) the audit log at path.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends e, stamping the time if it is unset.
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Query returns the most recent limit entries matching f, oldest first.
+// A limit of zero returns every match.
+func (l *Log) Query(f Filter, limit int) ([]Entry, error) {
+	entries := []Entry{}
+	err := l.scan(f, func(e Entry, _ []byte) error {
+		entries = append(entries, e)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Export writes every entry matching f to w as JSON lines, oldest first.
+func (l *Log) Export(w io.Writer, f Filter) error {
+	return l.scan(f, func(_ Entry, line []byte) error {
+		_, err := w.Write(append(line, '\n'))
+		return err
+	})
+}
+
+func (l *Log) scan(f Filter, fn func(Entry, []byte) error) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // A torn final line after a crash
+		}
+		if f.match(e) {
+			if err := fn(e, scanner.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
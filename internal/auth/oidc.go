@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"stackbill-deployer/internal/config"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCLoginTimeout bounds how long a user may take at the provider before the
+// pending login (state, nonce and PKCE verifier) is discarded.
+const OIDCLoginTimeout = 10 * time.Minute
+
+// maxPendingLogins caps the logins in progress, since anyone can start one.
+const maxPendingLogins = 1000
+
+// clockSkew is tolerated when checking ID token timestamps.
+const clockSkew = time.Minute
+
+// ErrTooManyLogins is returned by AuthURL when maxPendingLogins logins are
+// already in progress.
+var ErrTooManyLogins = errors.New("too many sign-ins in progress; try again in a few minutes")
+
+// OIDC performs single sign-on with an OpenID Connect provider using the
+// authorization code flow with PKCE, and maps the user's groups to a scope.
+// ID tokens are verified with go-oidc against the provider's published keys.
+type OIDC struct {
+	cfg      config.OIDCConfig
+	client   *http.Client
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mu      sync.Mutex
+	pending map[string]pendingLogin // Logins in progress, by state
+}
+
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// NewOIDC reads the provider's discovery document and checks the role map.
+func NewOIDC(ctx context.Context, cfg config.OIDCConfig) (*OIDC, error) {
+	for group, scope := range cfg.RoleMap {
+		if !Scope(scope).Valid() {
+			return nil, fmt.Errorf("role map: group %q has unknown scope %q", group, scope)
+		}
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	endpoint := provider.Endpoint()
+	if endpoint.AuthURL == "" || endpoint.TokenURL == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+	// Public clients identify themselves in the form; confidential ones
+	// authenticate with HTTP basic auth
+	endpoint.AuthStyle = oauth2.AuthStyleInParams
+	if cfg.ClientSecret != "" {
+		endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	}
+
+	return &OIDC{
+		cfg:    cfg,
+		client: client,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     endpoint,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{
+			ClientID: cfg.ClientID,
+			// Accept tokens that expired up to clockSkew ago on our clock
+			Now: func() time.Time { return time.Now().Add(-clockSkew) },
+		}),
+		pending: make(map[string]pendingLogin),
+	}, nil
+}
+
+// AuthURL starts a login and returns the provider URL to redirect the user to,
+// along with the login's state. The caller must bind the state to the user's
+// browser and check it before calling Callback; otherwise an attacker could
+// complete their own login in a victim's browser.
+func (o *OIDC) AuthURL() (string, string, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	o.mu.Lock()
+	now := time.Now()
+	for k, p := range o.pending {
+		if now.After(p.expires) {
+			delete(o.pending, k)
+		}
+	}
+	if len(o.pending) >= maxPendingLogins {
+		o.mu.Unlock()
+		return "", "", ErrTooManyLogins
+	}
+	o.pending[state] = pendingLogin{verifier: verifier, nonce: nonce, expires: now.Add(OIDCLoginTimeout)}
+	o.mu.Unlock()
+
+	return o.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), state, nil
+}
+
+// Callback completes a login: it redeems the authorization code, verifies
+// the ID token and returns the identity derived from its group claim.
+func (o *OIDC) Callback(ctx context.Context, state, code string) (Identity, error) {
+	o.mu.Lock()
+	p, ok := o.pending[state]
+	delete(o.pending, state) // Single use
+	o.mu.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return Identity{}, errors.New("login expired or was not started here; try again")
+	}
+
+	ctx = oidc.ClientContext(ctx, o.client)
+	token, err := o.oauth.Exchange(ctx, code, oauth2.VerifierOption(p.verifier))
+	if err != nil {
+		return Identity{}, fmt.Errorf("token request failed: %w", err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+	claims, err := o.verify(ctx, rawIDToken, p.nonce)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	return o.identity(claims)
+}
+
+// verify checks the ID token's signature, issuer, audience and expiry, then
+// the checks go-oidc leaves to the caller: the nonce of this login and the
+// authorized party.
+func (o *OIDC) verify(ctx context.Context, raw, nonce string) (map[string]interface{}, error) {
+	idToken, err := o.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	// A token for several audiences must name us as the party it was issued to
+	azp, _ := claims["azp"].(string)
+	if (len(idToken.Audience) > 1 && azp == "") || (azp != "" && azp != o.cfg.ClientID) {
+		return nil, fmt.Errorf("token was issued to %q, not this client", azp)
+	}
+	return claims, nil
+}
+
+// identity maps the user's groups to the highest configured scope.
+func (o *OIDC) identity(claims map[string]interface{}) (Identity, error) {
+	var groups []string
+	switch v := claims[o.cfg.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	var scope Scope
+	for _, g := range groups {
+		if s := Scope(o.cfg.RoleMap[g]); s.rank() > scope.rank() {
+			scope = s
+		}
+	}
+
+	name := ""
+	for _, claim := range []string{"email", "preferred_username", "sub"} {
+		if v, _ := claims[claim].(string); v != "" {
+			name = v
+			break
+		}
+	}
+	// Without a name, every such user would share one identity
+	if name == "" {
+		return Identity{}, errors.New("ID token has no email, preferred_username or sub claim")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return Identity{}, errors.New("ID token has no sub claim")
+	}
+	if !scope.Valid() {
+		return Identity{}, fmt.Errorf("%s is not in any group allowed to use the deployer", name)
+	}
+	return Identity{Name: "sso:" + name, Scope: scope, Subject: "oidc:" + sub}, nil
+}
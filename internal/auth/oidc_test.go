@@ -0,0 +1,476 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stackbill-deployer/internal/config"
+)
+
+const testClientID = "deployer"
+
+// testProvider is an OpenID Connect issuer serving discovery, JWKS and a
+// token endpoint that returns whatever ID token the test set up.
+type testProvider struct {
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	jwks        []map[string]string
+	idToken     string
+	challenge   string // PKCE challenge of the login being completed
+	jwksFetches int
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	p := &testProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.srv.URL,
+			"authorization_endpoint":                p.srv.URL + "/authorize",
+			"token_endpoint":                        p.srv.URL + "/token",
+			"jwks_uri":                              p.srv.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256", "ES256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.jwksFetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": p.jwks})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "the-code" || r.PostFormValue("client_id") != testClientID ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": p.idToken})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *testProvider) publish(keys ...map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jwks = keys
+}
+
+func (p *testProvider) fetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jwksFetches
+}
+
+func (p *testProvider) config() config.OIDCConfig {
+	return config.OIDCConfig{
+		Issuer:      p.srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://deployer.example.com/auth/oidc/callback",
+		Scopes:      []string{"openid", "email", "groups"},
+		GroupsClaim: "groups",
+		RoleMap:     map[string]string{"support": "read", "dev": "deploy", "ops": "admin"},
+	}
+}
+
+func (p *testProvider) newOIDC(t *testing.T) *OIDC {
+	t.Helper()
+	o, err := NewOIDC(context.Background(), p.config())
+	if err != nil {
+		t.Fatalf("NewOIDC: %v", err)
+	}
+	return o
+}
+
+// claims returns valid ID token claims for a login with nonce.
+func (p *testProvider) claims(nonce string, groups ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    p.srv.URL,
+		"aud":    testClientID,
+		"sub":    "user-1",
+		"email":  "alice@example.com",
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":  nonce,
+		"groups": groups,
+	}
+}
+
+// login runs a full login. makeToken builds the ID token the provider
+// returns, given the nonce the deployer sent.
+func (p *testProvider) login(t *testing.T, o *OIDC, makeToken func(nonce string) string) (Identity, error) {
+	t.Helper()
+	authURL, state, err := o.AuthURL()
+	if err != nil {
+		t.Fatalf("AuthURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parsing auth URL: %v", err)
+	}
+	q := u.Query()
+	if q.Get("state") != state || q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected auth URL %s", authURL)
+	}
+
+	p.mu.Lock()
+	p.challenge = q.Get("code_challenge")
+	p.idToken = makeToken(q.Get("nonce"))
+	p.mu.Unlock()
+	return o.Callback(context.Background(), state, "the-code")
+}
+
+func encodeJWT(header, claims map[string]interface{}, sign func(signed string) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+type rsaKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+func newRSAKey(t *testing.T, kid string) rsaKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey{kid: kid, key: key}
+}
+
+func (k rsaKey) jwk() map[string]string {
+	return map[string]string{
+		"kid": k.kid,
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+	}
+}
+
+func (k rsaKey) sign(claims map[string]interface{}) string {
+	return encodeJWT(map[string]interface{}{"alg": "RS256", "kid": k.kid}, claims, func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+		return sig
+	})
+}
+
+func TestOIDCMapsGroupsToHighestScope(t *testing.T) {
+	p := newTestProvider(t)
+	key := newRSAKey(t, "k1")
+	p.publish(key.jwk())
+	o := p.newOIDC(t)
+
+	tests := []struct {
+		groups interface{}
+		want   Scope
+	}{
+		{[]interface{}{"support"}, ScopeRead},
+		{[]interface{}{"support", "dev"}, ScopeDeploy},
+		{[]interface{}{"dev", "ops", "support"}, ScopeAdmin},
+		{[]interface{}{"marketing", "dev"}, ScopeDeploy},
+		{"ops", ScopeAdmin}, // Some providers send a single group as a string
+		{[]interface{}{"marketing"}, ""},
+		{[]interface{}{}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		id, err := p.login(t, o, func(nonce string) string {
+			claims := p.claims(nonce)
+			claims["groups"] = tt.groups
+			return key.sign(claims)
+		})
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("groups %v: got %+v, want the login refused", tt.groups, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("groups %v: %v", tt.groups, err)
+			continue
+		}
+		if id.Scope != tt.want || id.Name != "sso:alice@example.com" || id.Subject != "oidc:user-1" || id.TokenID != "" {
+			t.Errorf("groups %v: got %+v, want scope %s", tt.groups, id, tt.want)
+		}
+	}
+}
+
+func TestOIDCAcceptsES256(t *testing.T) {
+	p := newTestProvider(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.publish(map[string]string{
+		"kid": "ec1",
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	o := p.newOIDC(t)
+
+	id, err := p.login(t, o, func(nonce string) string {
+		return encodeJWT(map[string]interface{}{"alg": "ES256", "kid": "ec1"}, p.claims(nonce, "dev"), func(signed string) []byte {
+			digest := sha256.Sum256([]byte(signed))
+			r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		})
+	})
+	if err != nil || id.Scope != ScopeDeploy {
+		t.Fatalf("ES256 login = %+v, %v", id, err)
+	}
+}
+
+func TestOIDCRejectsInvalidTokens(t *testing.T) {
+	p := newTestProvider(t)
+	key := newRSAKey(t, "k1")
+	other := newRSAKey(t, "k1") // Same kid, key not published by the provider
+	p.publish(key.jwk())
+	o := p.newOIDC(t)
+
+	tests := []struct {
+		name      string
+		makeToken func(nonce string) string
+	}{
+		{"bad signature", func(nonce string) string {
+			return other.sign(p.claims(nonce, "ops"))
+		}},
+		{"tampered claims", func(nonce string) string {
+			parts := strings.Split(key.sign(p.claims(nonce, "support")), ".")
+			forged, _ := json.Marshal(p.claims(nonce, "ops"))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+		}},
+		{"alg none", func(nonce string) string {
+			return encodeJWT(map[string]interface{}{"alg": "none", "kid": "k1"}, p.claims(nonce, "ops"), func(string) []byte { return nil })
+		}},
+		{"HS256 keyed with the public key", func(nonce string) string {
+			return encodeJWT(map[string]interface{}{"alg": "HS256", "kid": "k1"}, p.claims(nonce, "ops"), func(signed string) []byte {
+				mac := hmac.New(sha256.New, key.key.N.Bytes())
+				mac.Write([]byte(signed))
+				return mac.Sum(nil)
+			})
+		}},
+		{"wrong audience", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["aud"] = "another-client"
+			return key.sign(claims)
+		}},
+		{"audience list without this client", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["aud"] = []string{"another-client", "a-third"}
+			return key.sign(claims)
+		}},
+		{"several audiences without azp", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["aud"] = []string{testClientID, "another-client"}
+			return key.sign(claims)
+		}},
+		{"issued to another party", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["azp"] = "another-client"
+			return key.sign(claims)
+		}},
+		{"wrong issuer", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["iss"] = "https://evil.example.com"
+			return key.sign(claims)
+		}},
+		{"nonce mismatch", func(nonce string) string {
+			return key.sign(p.claims(nonce+"x", "ops"))
+		}},
+		{"missing nonce", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			delete(claims, "nonce")
+			return key.sign(claims)
+		}},
+		{"expired", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+			return key.sign(claims)
+		}},
+		{"missing expiry", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			delete(claims, "exp")
+			return key.sign(claims)
+		}},
+		{"not yet valid", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["nbf"] = time.Now().Add(time.Hour).Unix()
+			return key.sign(claims)
+		}},
+		{"no name claims", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			delete(claims, "email")
+			delete(claims, "sub")
+			return key.sign(claims)
+		}},
+		{"no sub", func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			delete(claims, "sub")
+			return key.sign(claims)
+		}},
+		{"malformed", func(string) string {
+			return "not-a-jwt"
+		}},
+	}
+	for _, tt := range tests {
+		if id, err := p.login(t, o, tt.makeToken); err == nil {
+			t.Errorf("%s: login succeeded as %+v", tt.name, id)
+		}
+	}
+
+	// The same provider and key still log in valid tokens, including ones
+	// that expired within the tolerated clock skew and multi-audience
+	// tokens issued to this client
+	valid := map[string]func(nonce string) string{
+		"plain": func(nonce string) string { return key.sign(p.claims(nonce, "ops")) },
+		"expired within skew": func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+			return key.sign(claims)
+		},
+		"several audiences with azp": func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			claims["aud"] = []string{testClientID, "another-client"}
+			claims["azp"] = testClientID
+			return key.sign(claims)
+		},
+		"name from preferred_username": func(nonce string) string {
+			claims := p.claims(nonce, "ops")
+			delete(claims, "email")
+			claims["preferred_username"] = "alice"
+			return key.sign(claims)
+		},
+	}
+	for name, makeToken := range valid {
+		if _, err := p.login(t, o, makeToken); err != nil {
+			t.Errorf("%s: valid token rejected: %v", name, err)
+		}
+	}
+}
+
+func TestOIDCRefetchesKeysForUnknownKid(t *testing.T) {
+	p := newTestProvider(t)
+	first := newRSAKey(t, "k1")
+	p.publish(first.jwk())
+	o := p.newOIDC(t)
+
+	valid := func(key rsaKey) func(string) string {
+		return func(nonce string) string { return key.sign(p.claims(nonce, "dev")) }
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.login(t, o, valid(first)); err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+	}
+	if n := p.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times for a known kid, want 1", n)
+	}
+
+	// The provider rotates its key; the new kid triggers a refetch
+	second := newRSAKey(t, "k2")
+	p.publish(second.jwk())
+	if _, err := p.login(t, o, valid(second)); err != nil {
+		t.Fatalf("login with rotated key: %v", err)
+	}
+	if n := p.fetches(); n != 2 {
+		t.Fatalf("JWKS fetched %d times after rotation, want 2", n)
+	}
+
+	// Tokens signed with the retired key are no longer accepted
+	if _, err := p.login(t, o, valid(first)); err == nil {
+		t.Fatal("token signed with a retired key accepted")
+	}
+	if _, err := p.login(t, o, valid(newRSAKey(t, "k3"))); err == nil {
+		t.Fatal("token with a kid missing from the JWKS accepted")
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	p := newTestProvider(t)
+	key := newRSAKey(t, "k1")
+	p.publish(key.jwk())
+	o := p.newOIDC(t)
+
+	if _, err := o.Callback(context.Background(), "never-issued", "the-code"); err == nil {
+		t.Fatal("callback with an unknown state succeeded")
+	}
+
+	authURL, state, err := o.AuthURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	p.mu.Lock()
+	p.challenge = u.Query().Get("code_challenge")
+	p.idToken = key.sign(p.claims(u.Query().Get("nonce"), "dev"))
+	p.mu.Unlock()
+	if _, err := o.Callback(context.Background(), state, "the-code"); err != nil {
+		t.Fatalf("first callback: %v", err)
+	}
+	if _, err := o.Callback(context.Background(), state, "the-code"); err == nil {
+		t.Fatal("state was accepted twice")
+	}
+}
+
+func TestOIDCCapsPendingLogins(t *testing.T) {
+	p := newTestProvider(t)
+	o := p.newOIDC(t)
+	for i := 0; i < maxPendingLogins; i++ {
+		if _, _, err := o.AuthURL(); err != nil {
+			t.Fatalf("AuthURL %d: %v", i, err)
+		}
+	}
+	if _, _, err := o.AuthURL(); !errors.Is(err, ErrTooManyLogins) {
+		t.Fatalf("AuthURL beyond the cap: err = %v, want ErrTooManyLogins", err)
+	}
+
+	// Expired logins make room again
+	o.mu.Lock()
+	for state, pending := range o.pending {
+		pending.expires = time.Now().Add(-time.Second)
+		o.pending[state] = pending
+	}
+	o.mu.Unlock()
+	if _, _, err := o.AuthURL(); err != nil {
+		t.Fatalf("AuthURL after expiry: %v", err)
+	}
+}
+
+func TestNewOIDCRejectsUnknownScopes(t *testing.T) {
+	p := newTestProvider(t)
+	cfg := p.config()
+	cfg.RoleMap = map[string]string{"ops": "superuser"}
+	if _, err := NewOIDC(context.Background(), cfg); err == nil {
+		t.Fatal("NewOIDC accepted a role map with an unknown scope")
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Session is a browser login created by exchanging an API token. It carries
+// the token's identity and the CSRF token required on mutating requests.
+type Session struct {
+	ID        string
+	Identity  Identity
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// SessionStore keeps login sessions in memory; they end when the server
+// restarts.
+type SessionStore struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{ttl: ttl, sessions: make(map[string]Session)}
+}
+
+// Create starts a session for id.
+func (s *SessionStore) Create(id Identity) (Session, error) {
+	sid, err := randomHex(32)
+	if err != nil {
+		return Session{}, err
+	}
+	csrf, err := randomHex(32)
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{ID: sid, Identity: id, CSRFToken: csrf, ExpiresAt: time.Now().Add(s.ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Drop expired sessions so abandoned logins do not pile up
+	now := time.Now()
+	for k, v := range s.sessions {
+		if now.After(v.ExpiresAt) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[sid] = session
+	return session, nil
+}
+
+// Get returns the unexpired session with the given ID.
+func (s *SessionStore) Get(sid string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sid]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, sid)
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Delete ends a session.
+func (s *SessionStore) Delete(sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sid)
+}
+
+// DeleteForToken ends every session created with the given named token.
+func (s *SessionStore) DeleteForToken(tokenID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.sessions {
+		if v.Identity.TokenID == tokenID {
+			delete(s.sessions, k)
+		}
+	}
+}
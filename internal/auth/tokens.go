@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Scope is the access level of an API token. Each scope includes the ones
+// below it: admin > deploy > read.
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"   // View deployments and logs
+	ScopeDeploy Scope = "deploy" // Start, resume, cancel and uninstall deployments
+	ScopeAdmin  Scope = "admin"  // Manage tokens and read generated credentials
+)
+
+func (s Scope) rank() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeDeploy:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Valid reports whether s is a known scope.
+func (s Scope) Valid() bool {
+	return s.rank() > 0
+}
+
+// Allows reports whether a token with scope s may use an endpoint that
+// requires scope required.
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && s.rank() >= required.rank()
+}
+
+// Identity is the caller behind an authenticated request.
+type Identity struct {
+	TokenID string // Empty for the bootstrap admin token
+	Name    string
+	Scope   Scope
+	// Subject identifies the caller across logins and is never reused, unlike
+	// Name: "admin" for the bootstrap token, "token:<id>" for named tokens and
+	// "oidc:<sub>" for SSO users. Deployments are owned by it.
+	Subject string
+}
+
+// TokenSubject returns the Identity.Subject of the named token with ID id.
+func TokenSubject(id string) string {
+	return "token:" + id
+}
+
+// Token is a named API token. Only the SHA-256 hash of the secret is kept.
+type Token struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scope     Scope     `json:"scope"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"` // Name of the token that created this one
+}
+
+// ErrNameTaken is returned by Create when a token with the name exists.
+var ErrNameTaken = errors.New("a token with this name already exists")
+
+// TokenStore keeps named API tokens in a JSON file in the data directory.
+type TokenStore struct {
+	path   string
+	mu     sync.RWMutex
+	tokens []Token
+}
+
+// OpenTokenStore loads the tokens stored at path. A missing file means no
+// tokens have been created yet.
+func OpenTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Create adds a token and returns it along with its secret, which is not
+// stored and cannot be recovered later.
+func (s *TokenStore) Create(name string, scope Scope, createdBy string) (Token, string, error) {
+	if !scope.Valid() {
+		return Token{}, "", fmt.Errorf("unknown scope %q", scope)
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = "sbt_" + secret
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return Token{}, "", ErrNameTaken
+		}
+	}
+	token := Token{
+		ID:        id,
+		Name:      name,
+		Scope:     scope,
+		Hash:      hashSecret(secret),
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}
+	tokens := append(append([]Token(nil), s.tokens...), token)
+	if err := s.write(tokens); err != nil {
+		return Token{}, "", err
+	}
+	s.tokens = tokens
+	token.Hash = ""
+	return token, secret, nil
+}
+
+// Revoke deletes the token with the given ID. It reports whether it existed.
+func (s *TokenStore) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []Token
+	for _, t := range s.tokens {
+		if t.ID != id {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(s.tokens) {
+		return false, nil
+	}
+	if err := s.write(tokens); err != nil {
+		return false, err
+	}
+	s.tokens = tokens
+	return true, nil
+}
+
+// List returns all tokens without their hashes.
+func (s *TokenStore) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Token, len(s.tokens))
+	for i, t := range s.tokens {
+		t.Hash = ""
+		list[i] = t
+	}
+	return list
+}
+
+// Authenticate returns the token whose secret matches. Every stored hash is
+// compared in constant time, so timing does not reveal how close a guess is.
+func (s *TokenStore) Authenticate(secret string) (Token, bool) {
+	hash := []byte(hashSecret(secret))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var match Token
+	found := false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			match, found = t, true
+		}
+	}
+	return match, found
+}
+
+// write saves tokens atomically. Caller must hold s.mu.
+func (s *TokenStore) write(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save tokens: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) (*TokenStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("OpenTokenStore: %v", err)
+	}
+	return s, path
+}
+
+func TestTokenStorePersistsOnlyHashes(t *testing.T) {
+	s, path := openTestStore(t)
+	token, secret, err := s.Create("alice", ScopeDeploy, "admin")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(secret, "sbt_") {
+		t.Errorf("secret %q lacks the sbt_ prefix", secret)
+	}
+	if token.Hash != "" {
+		t.Error("Create returned the hash to the caller")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading tokens file: %v", err)
+	}
+	if strings.Contains(string(data), secret) || strings.Contains(string(data), strings.TrimPrefix(secret, "sbt_")) {
+		t.Fatal("tokens.json contains the plaintext secret")
+	}
+	if !strings.Contains(string(data), hashSecret(secret)) {
+		t.Fatal("tokens.json does not contain the secret's hash")
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("tokens.json mode = %v, want 0600", info.Mode().Perm())
+	}
+	for _, listed := range s.List() {
+		if listed.Hash != "" {
+			t.Error("List exposes token hashes")
+		}
+	}
+
+	// A fresh store reads the same tokens back and still authenticates
+	reopened, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, ok := reopened.Authenticate(secret)
+	if !ok || got.ID != token.ID || got.Name != "alice" || got.Scope != ScopeDeploy {
+		t.Fatalf("Authenticate after reopen = %+v, %v", got, ok)
+	}
+}
+
+func TestTokenStoreRejectsUnknownSecrets(t *testing.T) {
+	s, _ := openTestStore(t)
+	_, secret, err := s.Create("alice", ScopeRead, "admin")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, guess := range []string{"", "sbt_", secret + "x", secret[:len(secret)-1], hashSecret(secret)} {
+		if _, ok := s.Authenticate(guess); ok {
+			t.Errorf("Authenticate(%q) succeeded", guess)
+		}
+	}
+}
+
+func TestTokenStoreNamesAreUnique(t *testing.T) {
+	s, _ := openTestStore(t)
+	if _, _, err := s.Create("alice", ScopeRead, "admin"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := s.Create("alice", ScopeAdmin, "admin"); err != ErrNameTaken {
+		t.Fatalf("second Create error = %v, want ErrNameTaken", err)
+	}
+	if _, _, err := s.Create("bob", Scope("root"), "admin"); err == nil {
+		t.Fatal("Create accepted an unknown scope")
+	}
+}
+
+func TestRevokeRejectsTokenAndDropsSessions(t *testing.T) {
+	s, path := openTestStore(t)
+	token, secret, err := s.Create("alice", ScopeDeploy, "admin")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, other, err := s.Create("bob", ScopeDeploy, "admin")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	sessions := NewSessionStore(time.Hour)
+	id, _ := s.Authenticate(secret)
+	session, err := sessions.Create(Identity{TokenID: id.ID, Name: id.Name, Scope: id.Scope})
+	if err != nil {
+		t.Fatalf("sessions.Create: %v", err)
+	}
+	otherID, _ := s.Authenticate(other)
+	otherSession, _ := sessions.Create(Identity{TokenID: otherID.ID, Name: otherID.Name, Scope: otherID.Scope})
+
+	found, err := s.Revoke(token.ID)
+	if err != nil || !found {
+		t.Fatalf("Revoke = %v, %v", found, err)
+	}
+	sessions.DeleteForToken(token.ID)
+
+	if _, ok := s.Authenticate(secret); ok {
+		t.Error("revoked token still authenticates")
+	}
+	if _, ok := sessions.Get(session.ID); ok {
+		t.Error("session of the revoked token survived")
+	}
+	if _, ok := s.Authenticate(other); !ok {
+		t.Error("revoking one token rejected another")
+	}
+	if _, ok := sessions.Get(otherSession.ID); !ok {
+		t.Error("revoking one token dropped another token's session")
+	}
+
+	// The revocation is persisted
+	reopened, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, ok := reopened.Authenticate(secret); ok {
+		t.Error("revoked token authenticates after reopening the store")
+	}
+	if found, _ := s.Revoke(token.ID); found {
+		t.Error("revoking twice reported the token as found")
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	scopes := []Scope{ScopeRead, ScopeDeploy, ScopeAdmin}
+	for i, have := range scopes {
+		for j, need := range scopes {
+			if got, want := have.Allows(need), i >= j; got != want {
+				t.Errorf("%s.Allows(%s) = %v, want %v", have, need, got, want)
+			}
+		}
+	}
+	for _, bad := range []Scope{"", "root", "Admin"} {
+		if bad.Allows(ScopeRead) {
+			t.Errorf("invalid scope %q allows read", bad)
+		}
+	}
+}
@@ -6,16 +6,63 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Port       string
-	AnsibleDir string
-	AuthToken  string
-	DataDir    string
-	TLSCert    string
-	TLSKey     string
+	Port            string
+	AnsibleDir      string
+	AuthToken       string // Bootstrap admin token; named tokens live in the token store
+	AuthTokenSource string // Where the admin token was read from, shown at startup instead of the token
+	DataDir         string
+	TLSCert         string
+	TLSKey          string
+	Workers         int // Deployments run in parallel
+	MaxQueued       int // Deployments allowed to wait in the queue
+	SessionTTL      time.Duration
+
+	// Extra patterns masked in deployment logs, on top of the request's secrets
+	RedactPatterns []*regexp.Regexp
+
+	// Separate token required to read generated credentials; never logged
+	CredentialsToken string
+	// AES key used to encrypt stored credentials
+	CredentialsKeyFile string
+
+	// Optional OIDC single sign-on; disabled when Issuer is empty
+	OIDC OIDCConfig
+
+	// Per-client limits on deployment requests and failed token checks
+	RateLimit RateLimitConfig
+}
+
+// RateLimitConfig sets the token-bucket limits applied per client.
+type RateLimitConfig struct {
+	DeployPerMinute int // Deployment requests (deploy, pre-flight, resume, uninstall) per client IP and per token
+	DeployBurst     int
+	AuthFailures    int           // Failures a client IP, or an invalid token, may have in a burst before it is locked out
+	AuthPerMinute   int           // Rate at which the failure allowance refills
+	AuthLockout     time.Duration // How long a client IP or token is refused after exhausting its allowance
+}
+
+// OIDCConfig configures login through an OpenID Connect provider using the
+// authorization code flow with PKCE.
+type OIDCConfig struct {
+	Issuer       string // Must match the provider's issuer exactly, trailing slash included
+	ClientID     string
+	ClientSecret string // Optional; public clients rely on PKCE alone
+	RedirectURL  string // Must point at /auth/oidc/callback on this server
+	Scopes       []string
+	GroupsClaim  string            // ID token claim listing the user's groups
+	RoleMap      map[string]string // Group -> deployer scope (read, deploy or admin)
+}
+
+// Enabled reports whether OIDC login is configured.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
 }
 
 func Load() *Config {
@@ -43,8 +90,10 @@ func Load() *Config {
 
 	// Token priority: env var > data/token file > generate new and save
 	authToken := os.Getenv("SB_AUTH_TOKEN")
+	authTokenSource := "SB_AUTH_TOKEN"
 	if authToken == "" {
 		tokenFile := filepath.Join(dataDir, "token")
+		authTokenSource = tokenFile
 		if data, err := os.ReadFile(tokenFile); err == nil && len(strings.TrimSpace(string(data))) > 0 {
 			authToken = strings.TrimSpace(string(data))
 		}
@@ -56,17 +105,155 @@ func Load() *Config {
 		}
 		authToken = hex.EncodeToString(b)
 		tokenFile := filepath.Join(dataDir, "token")
+		// The token is no longer printed, so the file is the only way to read it
 		if err := os.WriteFile(tokenFile, []byte(authToken+"\n"), 0600); err != nil {
-			log.Printf("Warning: could not persist token to %s: %v", tokenFile, err)
+			log.Fatalf("Failed to save auth token to %s: %v", tokenFile, err)
 		}
 	}
 
+	credentialsToken := os.Getenv("SB_CREDENTIALS_TOKEN")
+	if credentialsToken == "" {
+		credentialsToken = loadOrCreateSecret(filepath.Join(dataDir, "credentials_token"), 32)
+	}
+	credentialsKeyFile := os.Getenv("SB_CREDENTIALS_KEY_FILE")
+	if credentialsKeyFile == "" {
+		credentialsKeyFile = filepath.Join(dataDir, "credentials.key")
+	}
+
+	sessionTTL := 12 * time.Hour
+	if v := os.Getenv("SB_SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("SB_SESSION_TTL must be a positive duration (e.g. 8h), got: %s", v)
+		}
+		sessionTTL = d
+	}
+
+	oidc := OIDCConfig{
+		Issuer:       os.Getenv("SB_OIDC_ISSUER"),
+		ClientID:     os.Getenv("SB_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("SB_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("SB_OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(envDefault("SB_OIDC_SCOPES", "openid profile email groups")),
+		GroupsClaim:  envDefault("SB_OIDC_GROUPS_CLAIM", "groups"),
+		RoleMap:      envMap("SB_OIDC_ROLE_MAP"),
+	}
+	if oidc.Enabled() && (oidc.ClientID == "" || oidc.RedirectURL == "" || len(oidc.RoleMap) == 0) {
+		log.Fatalf("SB_OIDC_ISSUER requires SB_OIDC_CLIENT_ID, SB_OIDC_REDIRECT_URL and SB_OIDC_ROLE_MAP")
+	}
+
+	authLockout := 15 * time.Minute
+	if v := os.Getenv("SB_AUTH_LOCKOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("SB_AUTH_LOCKOUT must be a positive duration (e.g. 15m), got: %s", v)
+		}
+		authLockout = d
+	}
+	rateLimit := RateLimitConfig{
+		DeployPerMinute: envInt("SB_DEPLOY_RATE", 6),
+		DeployBurst:     envInt("SB_DEPLOY_BURST", 3),
+		AuthFailures:    envInt("SB_AUTH_FAILURES", 10),
+		AuthPerMinute:   envInt("SB_AUTH_FAILURE_RATE", 1),
+		AuthLockout:     authLockout,
+	}
+
+	workers := envInt("SB_WORKERS", 2)
+	maxQueued := envInt("SB_MAX_QUEUED", 50)
+
 	return &Config{
-		Port:       port,
-		AnsibleDir: ansibleDir,
-		AuthToken:  authToken,
-		DataDir:    dataDir,
-		TLSCert:    os.Getenv("SB_TLS_CERT"),
-		TLSKey:     os.Getenv("SB_TLS_KEY"),
+		Port:            port,
+		AnsibleDir:      ansibleDir,
+		AuthToken:       authToken,
+		AuthTokenSource: authTokenSource,
+		DataDir:         dataDir,
+		TLSCert:         os.Getenv("SB_TLS_CERT"),
+		TLSKey:          os.Getenv("SB_TLS_KEY"),
+		Workers:         workers,
+		MaxQueued:       maxQueued,
+		SessionTTL:      sessionTTL,
+		RedactPatterns:  envPatterns("SB_REDACT_PATTERNS"),
+
+		CredentialsToken:   credentialsToken,
+		CredentialsKeyFile: credentialsKeyFile,
+
+		OIDC:      oidc,
+		RateLimit: rateLimit,
+	}
+}
+
+func envDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envMap parses comma-separated key=value pairs, e.g. "sb-admins=admin,sb-ops=deploy".
+func envMap(name string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			log.Fatalf("%s: expected key=value, got %q", name, pair)
+		}
+		m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return m
+}
+
+// loadOrCreateSecret returns the token stored in path, generating and saving
+// a random one of n bytes if the file is missing or empty.
+func loadOrCreateSecret(path string, n int) string {
+	if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data))
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate %s: %v", filepath.Base(path), err)
+	}
+	secret := hex.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		log.Fatalf("Failed to save %s: %v", path, err)
+	}
+	return secret
+}
+
+// envInt reads a positive integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("%s must be a positive integer, got: %s", name, v)
+	}
+	return n
+}
+
+// envPatterns compiles the regular expressions listed one per line in the
+// environment variable name. Blank lines are ignored.
+func envPatterns(name string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, line := range strings.Split(os.Getenv(name), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			log.Fatalf("%s: invalid pattern %q: %v", name, line, err)
+		}
+		// A pattern matching nothing would put a mask between every character
+		if re.MatchString("") {
+			log.Fatalf("%s: pattern %q matches the empty string", name, line)
+		}
+		patterns = append(patterns, re)
 	}
+	return patterns
 }
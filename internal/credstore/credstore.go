@@ -0,0 +1,124 @@
+package credstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stackbill-deployer/internal/models"
+)
+
+// Store keeps each deployment's generated credentials in dir/<id>.enc,
+// sealed with AES-256-GCM. The deployment ID is bound as additional data,
+// so a file copied to another ID fails to open.
+type Store struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// Open creates the credentials directory if needed and loads the encryption
+// key from keyPath, generating it on first use.
+func Open(dir, keyPath string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, aead: aead}, nil
+}
+
+// loadKey reads the hex-encoded 256-bit key at path, creating it if missing.
+func loadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate credentials key: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save credentials key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials key: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("credentials key %s must be 64 hex characters", path)
+	}
+	return key, nil
+}
+
+// Save encrypts and writes the credentials of deployment id.
+func (s *Store) Save(id string, creds *models.Credentials) error {
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plain, []byte(id))
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := s.path(id) + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write credentials: %w", err)
+	}
+	return os.Rename(tmp, s.path(id))
+}
+
+// Load returns the credentials of deployment id, or nil if none are stored.
+func (s *Store) Load(id string) (*models.Credentials, error) {
+	sealed, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("credentials file for %s is truncated", id)
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials for %s: %w", id, err)
+	}
+	var creds models.Credentials
+	if err := json.Unmarshal(plain, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// Delete removes the credentials of deployment id, if any are stored.
+func (s *Store) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete credentials: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".enc")
+}
@@ -0,0 +1,128 @@
+package credstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"stackbill-deployer/internal/models"
+)
+
+func testCredentials() *models.Credentials {
+	return &models.Credentials{
+		PortalURL: "https://portal.example.com",
+		ServerIP:  "192.0.2.10",
+		MySQL:     models.ServiceCredentials{Host: "192.0.2.10", Port: "3306", Username: "stackbill", Password: "mysql-secret"},
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "credentials"), filepath.Join(dir, "credentials.key"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Save("dep-1", testCredentials()); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// A store reopened with the same key reads the credentials back
+	s, err = Open(filepath.Join(dir, "credentials"), filepath.Join(dir, "credentials.key"))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, err := s.Load("dep-1")
+	if err != nil || got == nil || *got != *testCredentials() {
+		t.Fatalf("Load = %+v, %v", got, err)
+	}
+	if got, err := s.Load("dep-2"); got != nil || err != nil {
+		t.Errorf("Load of a deployment without credentials = %+v, %v", got, err)
+	}
+
+	data, err := os.ReadFile(s.path("dep-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"mysql-secret", "stackbill", "192.0.2.10"} {
+		if bytes.Contains(data, []byte(plain)) {
+			t.Errorf("credentials file contains %q in plaintext", plain)
+		}
+	}
+
+	if err := s.Delete("dep-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, err := s.Load("dep-1"); got != nil || err != nil {
+		t.Errorf("Load after Delete = %+v, %v", got, err)
+	}
+	if err := s.Delete("dep-1"); err != nil {
+		t.Errorf("deleting twice: %v", err)
+	}
+}
+
+func TestFilePermissions(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "credentials.key")
+	s, err := Open(filepath.Join(dir, "credentials"), keyPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Save("dep-1", testCredentials()); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for path, want := range map[string]os.FileMode{
+		keyPath:                           0600,
+		filepath.Join(dir, "credentials"): 0700,
+		s.path("dep-1"):                   0600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %v, want %v", filepath.Base(path), got, want)
+		}
+	}
+}
+
+func TestLoadRejectsWrongKeyAndMovedFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "credentials"), filepath.Join(dir, "credentials.key"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Save("dep-1", testCredentials()); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Another key cannot open the file
+	other, err := Open(filepath.Join(dir, "credentials"), filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatalf("Open with another key: %v", err)
+	}
+	if got, err := other.Load("dep-1"); err == nil {
+		t.Errorf("Load with the wrong key = %+v, want an error", got)
+	}
+
+	// Nor can a file copied to another deployment's name
+	data, err := os.ReadFile(s.path("dep-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path("dep-2"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Load("dep-2"); err == nil {
+		t.Errorf("Load of a file moved to another ID = %+v, want an error", got)
+	}
+
+	// A malformed key file is refused rather than replaced
+	bad := filepath.Join(dir, "bad.key")
+	if err := os.WriteFile(bad, []byte("not hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filepath.Join(dir, "credentials"), bad); err == nil {
+		t.Error("Open accepted a malformed key file")
+	}
+}
@@ -0,0 +1,85 @@
+package deployer
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"stackbill-deployer/internal/models"
+)
+
+// parseCredentials reads the credentials.txt written by the save_credentials
+// role. Lines are "Key: Value" pairs grouped under "SECTION:" headers; the
+// CloudStack user is a nested section.
+func parseCredentials(data []byte) *models.Credentials {
+	fields := make(map[string]string) // "SECTION.Key" -> value
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "====") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			section = key
+			continue
+		}
+		fields[section+"."+key] = value
+	}
+
+	get := func(key string) string {
+		v := fields[key]
+		// Placeholders for values the playbook could not generate
+		if v == "N/A" || strings.HasPrefix(v, "(") {
+			return ""
+		}
+		return v
+	}
+
+	creds := &models.Credentials{
+		// Top-level lines are read before the first section header
+		PortalURL: get(".PORTAL URL"),
+		ServerIP:  get(".SERVER IP"),
+		MySQL: models.ServiceCredentials{
+			Host:     get("MYSQL.Host"),
+			Port:     get("MYSQL.Port"),
+			Database: get("MYSQL.Database"),
+			Username: get("MYSQL.Username"),
+			Password: get("MYSQL.MySQL Password"),
+		},
+		MongoDB: models.ServiceCredentials{
+			Host:     get("MONGODB.Host"),
+			Port:     get("MONGODB.Port"),
+			Database: get("MONGODB.Database"),
+			Username: get("MONGODB.Username"),
+			Password: get("MONGODB.MongoDB Password"),
+		},
+		RabbitMQ: models.ServiceCredentials{
+			Host:          get("RABBITMQ.Host"),
+			Port:          get("RABBITMQ.Port"),
+			Username:      get("RABBITMQ.Username"),
+			Password:      get("RABBITMQ.RabbitMQ Password"),
+			ManagementURL: get("RABBITMQ.Management"),
+		},
+		NFS: models.NFSExport{
+			Server: get("NFS.Server"),
+			Path:   get("NFS.Path"),
+		},
+	}
+	if url := get("CLOUDSTACK SIMULATOR.URL"); url != "" {
+		creds.CloudStack = &models.CloudStackAccess{
+			URL:       url,
+			APIURL:    get("CLOUDSTACK SIMULATOR.API"),
+			Username:  get("STACKBILL CLOUDSTACK USER.Username"),
+			Password:  get("STACKBILL CLOUDSTACK USER.Password"),
+			APIKey:    get("STACKBILL CLOUDSTACK USER.API Key"),
+			SecretKey: get("STACKBILL CLOUDSTACK USER.Secret Key"),
+		}
+	}
+	return creds
+}
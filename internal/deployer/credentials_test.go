@@ -0,0 +1,108 @@
+package deployer
+
+import (
+	"strings"
+	"testing"
+
+	"stackbill-deployer/internal/models"
+)
+
+// generatedCredentials is credentials.txt as rendered by the save_credentials
+// role, with the CloudStack simulator section when simulator is set.
+func generatedCredentials(simulator bool) string {
+	text := `================================================================================
+STACKBILL POC CREDENTIALS
+Generated: 2026-01-01T10:00:00Z
+================================================================================
+
+PORTAL URL: https://portal.example.com
+
+SERVER IP: 192.0.2.10
+
+MYSQL:
+  Host: 192.0.2.10
+  Port: 3306
+  Database: stackbill
+  MySQL Password: my:sql-pass
+  Username: stackbill
+
+MONGODB:
+  Host: 192.0.2.10
+  Port: 27017
+  Database: admin
+  Username: stackbill
+  MongoDB Password: mongo-pass
+
+RABBITMQ:
+  Host: 192.0.2.10
+  Port: 5672
+  Username: stackbill
+  RabbitMQ Password: rabbit-pass
+  Management: http://192.0.2.10:15672
+
+NFS:
+  Server: 192.0.2.10
+  Path: /data/stackbill
+
+`
+	if simulator {
+		text += `CLOUDSTACK SIMULATOR:
+  URL: http://192.0.2.10:8080
+  API: http://192.0.2.10:8080/client/api
+  Default Admin: admin / password
+
+  STACKBILL CLOUDSTACK USER:
+    Username: stackbill-admin
+    Password: cs-pass
+    API Key: (generate from CloudStack UI)
+    Secret Key: (generate from CloudStack UI)
+
+`
+	}
+	return text + "================================================================================\n"
+}
+
+func TestParseCredentials(t *testing.T) {
+	creds := parseCredentials([]byte(generatedCredentials(false)))
+	want := models.Credentials{
+		PortalURL: "https://portal.example.com",
+		ServerIP:  "192.0.2.10",
+		MySQL:     models.ServiceCredentials{Host: "192.0.2.10", Port: "3306", Database: "stackbill", Username: "stackbill", Password: "my:sql-pass"},
+		MongoDB:   models.ServiceCredentials{Host: "192.0.2.10", Port: "27017", Database: "admin", Username: "stackbill", Password: "mongo-pass"},
+		RabbitMQ: models.ServiceCredentials{Host: "192.0.2.10", Port: "5672", Username: "stackbill", Password: "rabbit-pass",
+			ManagementURL: "http://192.0.2.10:15672"},
+		NFS: models.NFSExport{Server: "192.0.2.10", Path: "/data/stackbill"},
+	}
+	if *creds != want {
+		t.Errorf("parseCredentials =\n%+v\nwant\n%+v", *creds, want)
+	}
+}
+
+func TestParseCredentialsSimulator(t *testing.T) {
+	creds := parseCredentials([]byte(generatedCredentials(true)))
+	if creds.CloudStack == nil {
+		t.Fatal("CloudStack section not parsed")
+	}
+	want := models.CloudStackAccess{
+		URL:      "http://192.0.2.10:8080",
+		APIURL:   "http://192.0.2.10:8080/client/api",
+		Username: "stackbill-admin",
+		Password: "cs-pass",
+		// Placeholders for keys the playbook could not generate are dropped
+	}
+	if *creds.CloudStack != want {
+		t.Errorf("CloudStack = %+v, want %+v", *creds.CloudStack, want)
+	}
+	if creds.MySQL.Password != "my:sql-pass" {
+		t.Errorf("MySQL password = %q alongside the simulator section", creds.MySQL.Password)
+	}
+}
+
+func TestParseCredentialsPartialFile(t *testing.T) {
+	// A file cut short keeps whatever was written
+	text := generatedCredentials(false)
+	creds := parseCredentials([]byte(text[:strings.Index(text, "MONGODB:")]))
+	if creds.MySQL.Password != "my:sql-pass" || creds.MongoDB != (models.ServiceCredentials{}) || creds.CloudStack != nil {
+		t.Errorf("parseCredentials of a partial file = %+v", creds)
+	}
+}
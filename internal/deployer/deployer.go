@@ -2,6 +2,7 @@ package deployer
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,7 +11,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"stackbill-deployer/internal/config"
 	"stackbill-deployer/internal/models"
@@ -21,55 +24,163 @@ var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]|\x1b\].*?(\x07|\x1b\\)
 type LogCallback func(line string)
 
 type Deployer struct {
-	cfg *config.Config
+	cfg      *config.Config
+	hostKeys *hostKeyStore
 }
 
 func New(cfg *config.Config) *Deployer {
-	return &Deployer{cfg: cfg}
+	return &Deployer{
+		cfg:      cfg,
+		hostKeys: &hostKeyStore{path: filepath.Join(cfg.DataDir, "known_hosts")},
+	}
 }
 
-func (d *Deployer) Deploy(req models.DeployRequest, onLog LogCallback) error {
-	onLog("Preparing Ansible deployment to " + req.ServerIP + "...")
+// Deploy runs the playbook against the target server, streaming output to onLog
+// and structured callback events to onEvent. On success it returns the
+// credentials saved on the server, or nil if the run did not save them.
+// Cancelling ctx kills the whole ansible-playbook process group.
+func (d *Deployer) Deploy(ctx context.Context, req models.DeployRequest, onLog LogCallback, onEvent EventCallback) (*models.Credentials, error) {
+	// Mask secrets before any sink sees a line
+	onLog, onEvent = newRedactor(req, d.cfg.RedactPatterns).wrap(onLog, onEvent)
+
+	playbook := d.getPlaybookPath()
+	if req.Type == models.DeployTypeUninstall {
+		playbook = d.getUninstallPlaybookPath()
+		onLog("Preparing to uninstall StackBill from " + req.ServerIP + "...")
+	} else {
+		onLog("Preparing Ansible deployment to " + req.ServerIP + "...")
+	}
+	if len(req.Nodes) > 0 {
+		onLog(fmt.Sprintf("Cluster: %d additional node(s)", len(req.Nodes)))
+	}
 
 	// Create temp directory for inventory and vars (cleaned up after)
 	tmpDir, err := os.MkdirTemp("", "sb-deploy-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
+	// save_credentials copies the generated credentials here
+	credsPath := filepath.Join(tmpDir, "credentials.txt")
+	args, env, err := d.prepare(tmpDir, req, map[string]string{"credentials_fetch_path": credsPath}, onLog)
+	if err != nil {
+		return nil, err
+	}
+	args = append([]string{playbook}, args...)
+
+	onLog("Starting Ansible playbook...")
+
+	// Upgrades and resumed runs execute only the listed roles; pre_tasks are tagged "always"
+	if req.Type == models.DeployTypeUpgrade {
+		onLog("Upgrading StackBill to chart version " + req.ChartVersion)
+	}
+	if len(req.Roles) > 0 {
+		args = append(args, "--tags", strings.Join(req.Roles, ","))
+		if req.Type != models.DeployTypeUpgrade {
+			onLog("Resuming from role: " + req.Roles[0])
+		}
+	}
+
+	if err := d.runPlaybook(ctx, args, env, onLog, onEvent); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("deployment cancelled: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("deployment failed: %w", err)
+	}
+
+	if req.Type == models.DeployTypeUninstall {
+		onLog("Uninstall completed successfully!")
+		return nil, nil
+	}
+	onLog("Deployment completed successfully!")
+
+	// Missing for upgrades, which do not run save_credentials
+	data, err := os.ReadFile(credsPath)
+	if err != nil {
+		return nil, nil
+	}
+	return parseCredentials(data), nil
+}
+
+// prepare writes the SSH key, pinned host keys, jump host settings, inventory
+// and extra vars into tmpDir and returns the matching ansible-playbook
+// arguments, plus the environment carrying the secrets the inventory and vars
+// look up. extraVars are added to the deployment variables.
+func (d *Deployer) prepare(tmpDir string, req models.DeployRequest, extraVars map[string]string, onLog LogCallback) ([]string, []string, error) {
+	// Write uploaded SSH private key (decrypted, 0600) next to the inventory
+	if req.SSHKey != "" {
+		req.SSHKeyPath = filepath.Join(tmpDir, "id_deploy")
+		if err := writePrivateKey(req.SSHKeyPath, req.SSHKey, req.SSHKeyPassphrase); err != nil {
+			return nil, nil, fmt.Errorf("failed to write SSH key: %w", err)
+		}
+	}
+
+	// Only the keys pinned for this deployment's hosts are trusted
+	knownHostsPath := filepath.Join(tmpDir, "known_hosts")
+	if err := d.hostKeys.writeKnownHosts(knownHostsPath, requestAddrs(req)); err != nil {
+		return nil, nil, err
+	}
+	hostKeyOpts := fmt.Sprintf("-o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", knownHostsPath)
+
+	// Write bastion credentials and build the proxy hop arguments
+	proxyArgs, err := prepareJumpHost(tmpDir, req, hostKeyOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	sshCommonArgs := hostKeyOpts
+	if proxyArgs != "" {
+		onLog("Connecting through jump host " + req.JumpHost + "...")
+		sshCommonArgs += " " + proxyArgs
+	}
+
 	// Write dynamic inventory
 	inventoryPath := filepath.Join(tmpDir, "inventory.ini")
-	if err := d.writeInventory(inventoryPath, req); err != nil {
-		return fmt.Errorf("failed to write inventory: %w", err)
+	if err := d.writeInventory(inventoryPath, req, sshCommonArgs); err != nil {
+		return nil, nil, fmt.Errorf("failed to write inventory: %w", err)
 	}
 
 	// Write extra vars JSON
 	varsPath := filepath.Join(tmpDir, "vars.json")
-	if err := d.writeVars(varsPath, req); err != nil {
-		return fmt.Errorf("failed to write vars: %w", err)
+	if err := d.writeVars(varsPath, req, extraVars); err != nil {
+		return nil, nil, fmt.Errorf("failed to write vars: %w", err)
 	}
 
-	// Get playbook path
-	playbookPath := d.getPlaybookPath()
-	ansibleCfgPath := d.getAnsibleCfgPath()
-
-	onLog("Starting Ansible playbook...")
-
-	// Build and run ansible-playbook command
-	args := []string{
-		playbookPath,
-		"-i", inventoryPath,
-		"--extra-vars", "@" + varsPath,
-	}
+	return []string{"-i", inventoryPath, "--extra-vars", "@" + varsPath}, secretEnv(req), nil
+}
 
-	cmd := exec.Command("ansible-playbook", args...)
+// runPlaybook runs ansible-playbook with args and the extra environment env,
+// streaming output to onLog and structured callback events to onEvent.
+// Cancelling ctx kills the whole ansible-playbook process group.
+func (d *Deployer) runPlaybook(ctx context.Context, args, env []string, onLog LogCallback, onEvent EventCallback) error {
+	cmd := exec.CommandContext(ctx, "ansible-playbook", args...)
+	// Run in its own process group so cancellation also reaches ssh/sshpass children
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = 10 * time.Second
 	cmd.Env = append(os.Environ(),
-		"ANSIBLE_CONFIG="+ansibleCfgPath,
+		"ANSIBLE_CONFIG="+d.getAnsibleCfgPath(),
 		"ANSIBLE_NOCOLOR=1",
 		"ANSIBLE_FORCE_COLOR=0",
-		"ANSIBLE_HOST_KEY_CHECKING=False",
+		"ANSIBLE_HOST_KEY_CHECKING=True",
+		fmt.Sprintf("SB_EVENT_FD=%d", eventFD),
+		fmt.Sprintf("SB_EVENT_ACK_FD=%d", eventAckFD),
 	)
+	cmd.Env = append(cmd.Env, env...)
+
+	// Dedicated pipe for structured events from the callback plugin
+	eventsR, eventsW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create event pipe: %w", err)
+	}
+	defer eventsR.Close()
+	ackR, ackW, err := os.Pipe()
+	if err != nil {
+		eventsW.Close()
+		return fmt.Errorf("failed to create event pipe: %w", err)
+	}
+	defer ackW.Close()
+	cmd.ExtraFiles = []*os.File{eventsW, ackR}
 
 	// Pipe stdout and stderr
 	stdout, err := cmd.StdoutPipe()
@@ -82,60 +193,105 @@ func (d *Deployer) Deploy(req models.DeployRequest, onLog LogCallback) error {
 	}
 
 	if err := cmd.Start(); err != nil {
+		eventsW.Close()
+		ackR.Close()
 		return fmt.Errorf("failed to start ansible-playbook: %w", err)
 	}
+	// The child holds its own copies; closing ours lets the reader see EOF on exit
+	eventsW.Close()
+	ackR.Close()
 
-	// Stream output
-	done := make(chan struct{}, 2)
+	// Stream output and events
+	done := make(chan struct{}, 3)
 	go func() { streamLines(stdout, onLog); done <- struct{}{} }()
 	go func() { streamLines(stderr, onLog); done <- struct{}{} }()
+	go func() { streamEvents(eventsR, ackW, onEvent); done <- struct{}{} }()
 
-	// Wait for both streams to finish
+	// Wait for all streams to finish
+	<-done
 	<-done
 	<-done
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("deployment failed: %w", err)
-	}
-
-	onLog("Deployment completed successfully!")
-	return nil
+	return cmd.Wait()
 }
 
 // writeInventory creates a temporary Ansible inventory file with target host details.
-func (d *Deployer) writeInventory(path string, req models.DeployRequest) error {
+// Additional cluster nodes go into the k3s_servers and k3s_agents groups and share
+// the target's connection settings. sshCommonArgs carries the host key options
+// and, when set, the jump host hop.
+func (d *Deployer) writeInventory(path string, req models.DeployRequest, sshCommonArgs string) error {
 	sshPort := req.SSHPort
 	if sshPort == 0 {
 		sshPort = 22
 	}
 
 	become := "yes"
-	becomePass := req.SSHPass
+	becomePass := req.SSHPass != ""
 	if req.SSHUser == "root" {
 		become = "no"
-		becomePass = ""
+		becomePass = false
+	}
+
+	var hostVars strings.Builder
+	hostVar := func(name, value string) {
+		hostVars.WriteString(" " + name + "=" + iniQuote(value))
+	}
+	hostVar("ansible_user", req.SSHUser)
+	hostVar("ansible_port", strconv.Itoa(sshPort))
+	hostVar("ansible_become", become)
+
+	if req.SSHKeyPath != "" {
+		hostVar("ansible_ssh_private_key_file", req.SSHKeyPath)
+	}
+	// Passwords are looked up from the environment so they never reach the disk
+	if req.SSHPass != "" {
+		hostVar("ansible_ssh_pass", envLookup(envSSHPass))
+	}
+	hostVar("ansible_ssh_common_args", sshCommonArgs)
+
+	if becomePass {
+		hostVar("ansible_become_pass", envLookup(envSSHPass))
 	}
 
 	var sb strings.Builder
 	sb.WriteString("[target]\n")
-	sb.WriteString(fmt.Sprintf("%s ansible_user=%s ansible_ssh_pass=%s ansible_port=%d ansible_become=%s",
-		req.ServerIP, req.SSHUser, req.SSHPass, sshPort, become))
+	sb.WriteString(req.ServerIP + hostVars.String() + "\n")
 
-	if becomePass != "" {
-		sb.WriteString(fmt.Sprintf(" ansible_become_pass=%s", becomePass))
+	// The groups are always written so the join play matches no hosts instead
+	// of warning about an unknown pattern on single-server deployments
+	for _, group := range []struct{ name, role string }{
+		{"k3s_servers", models.NodeRoleServer},
+		{"k3s_agents", models.NodeRoleAgent},
+	} {
+		sb.WriteString("\n[" + group.name + "]\n")
+		for _, node := range req.Nodes {
+			if node.Role == group.role {
+				sb.WriteString(fmt.Sprintf("%s%s k3s_role=%s\n", node.Host, hostVars.String(), node.Role))
+			}
+		}
 	}
-	sb.WriteString("\n")
+	sb.WriteString("\n[k3s_nodes:children]\nk3s_servers\nk3s_agents\n")
 
 	return os.WriteFile(path, []byte(sb.String()), 0600)
 }
 
 // writeVars creates a temporary JSON file with deployment variables.
-func (d *Deployer) writeVars(path string, req models.DeployRequest) error {
+func (d *Deployer) writeVars(path string, req models.DeployRequest, extraVars map[string]string) error {
 	vars := map[string]string{
 		"domain":          req.Domain,
 		"ssl_mode":        req.SSLMode,
 		"cloudstack_mode": req.CloudStackMode,
-		"ecr_token":       req.ECRToken,
+		"ecr_token":       envLookup(envECRToken),
+		"deploy_type":     req.Type,
+	}
+	if req.ChartVersion != "" {
+		vars["stackbill_chart_version"] = req.ChartVersion
+	}
+	if req.Type == models.DeployTypeUninstall {
+		vars["delete_pvc"] = strconv.FormatBool(req.Uninstall.DeletePVC)
+		vars["delete_namespace"] = strconv.FormatBool(req.Uninstall.DeleteNamespace)
+		vars["delete_databases"] = strconv.FormatBool(req.Uninstall.DeleteDatabases)
+		vars["remove_simulator"] = strconv.FormatBool(req.Uninstall.RemoveSimulator)
 	}
 
 	if req.SSLMode == "letsencrypt" && req.LetsEncryptEmail != "" {
@@ -143,11 +299,14 @@ func (d *Deployer) writeVars(path string, req models.DeployRequest) error {
 	}
 	if req.SSLMode == "custom" {
 		vars["ssl_cert_content"] = req.SSLCert
-		vars["ssl_key_content"] = req.SSLKey
+		vars["ssl_key_content"] = envLookup(envSSLKey)
 	}
 	if req.CloudStackMode == "simulator" && req.CloudStackVersion != "" {
 		vars["cloudstack_version"] = req.CloudStackVersion
 	}
+	for k, v := range extraVars {
+		vars[k] = v
+	}
 
 	data, err := json.Marshal(vars)
 	if err != nil {
@@ -163,6 +322,20 @@ func (d *Deployer) getPlaybookPath() string {
 	return filepath.Join(projectRoot, d.cfg.AnsibleDir, "playbook.yml")
 }
 
+// getUninstallPlaybookPath returns the absolute path to the uninstall playbook.
+func (d *Deployer) getUninstallPlaybookPath() string {
+	_, filename, _, _ := runtime.Caller(0)
+	projectRoot := filepath.Join(filepath.Dir(filename), "..", "..")
+	return filepath.Join(projectRoot, d.cfg.AnsibleDir, "uninstall.yml")
+}
+
+// getPreflightPlaybookPath returns the absolute path to the pre-flight playbook.
+func (d *Deployer) getPreflightPlaybookPath() string {
+	_, filename, _, _ := runtime.Caller(0)
+	projectRoot := filepath.Join(filepath.Dir(filename), "..", "..")
+	return filepath.Join(projectRoot, d.cfg.AnsibleDir, "preflight.yml")
+}
+
 // getAnsibleCfgPath returns the absolute path to ansible.cfg.
 func (d *Deployer) getAnsibleCfgPath() string {
 	_, filename, _, _ := runtime.Caller(0)
@@ -0,0 +1,75 @@
+package deployer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// EventType identifies a structured event emitted by the stackbill_log callback plugin.
+type EventType string
+
+const (
+	EventRoleStart   EventType = "role_start"
+	EventRoleEnd     EventType = "role_end"
+	EventTaskOK      EventType = "task_ok"
+	EventTaskChanged EventType = "task_changed"
+	EventTaskFailed  EventType = "task_failed"
+	EventUnreachable EventType = "unreachable"
+	EventStats       EventType = "stats"
+	EventSecret      EventType = "secret" // A value generated during the run that must be masked in logs
+)
+
+// Event is a single structured event decoded from the callback plugin's event fd.
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	Role         string    `json:"role,omitempty"`
+	Task         string    `json:"task,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	Message      string    `json:"msg,omitempty"`
+	Duration     float64   `json:"duration,omitempty"` // Seconds spent in the task or role
+	IgnoreErrors bool      `json:"ignore_errors,omitempty"`
+
+	// Populated on EventSecret only; never passed on to EventCallbacks
+	Value string `json:"value,omitempty"`
+
+	// Populated on EventStats only
+	OK          int `json:"ok,omitempty"`
+	Changed     int `json:"changed,omitempty"`
+	Failures    int `json:"failures,omitempty"`
+	Unreachable int `json:"unreachable,omitempty"`
+}
+
+type EventCallback func(event Event)
+
+// eventFD is the file descriptor number the event pipe is mapped to in
+// ansible-playbook (ExtraFiles start at 3, after stdin/stdout/stderr).
+const eventFD = 3
+
+// eventAckFD is the file descriptor on which ansible-playbook reads an
+// acknowledgement for each secret event. The callback plugin waits for it
+// before producing more output, so a generated password is always registered
+// with the redactor before any stdout or stderr line can carry it.
+const eventAckFD = 4
+
+// streamEvents decodes newline-delimited JSON events until the pipe is closed,
+// writing a line to ack once each secret event has been handled.
+func streamEvents(r io.Reader, ack io.Writer, onEvent EventCallback) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("Ignoring malformed callback event: %v", err)
+			continue
+		}
+		onEvent(event)
+		if event.Type == EventSecret {
+			// Fails only once ansible-playbook has exited, when nobody is waiting
+			io.WriteString(ack, "\n")
+		}
+	}
+}
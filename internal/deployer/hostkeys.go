@@ -0,0 +1,180 @@
+package deployer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"stackbill-deployer/internal/models"
+)
+
+// HostKey is a server host key seen by CheckSSH.
+type HostKey struct {
+	Fingerprint string // SHA256 fingerprint, as printed by ssh-keygen -l
+	Known       bool   // Already pinned from an earlier deployment
+	key         ssh.PublicKey
+}
+
+// hostKeyStore pins server host keys on first contact in an OpenSSH
+// known_hosts file in the data directory.
+type hostKeyStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// hostAddr returns the known_hosts form of host:port ("host" for port 22,
+// "[host]:port" otherwise).
+func hostAddr(host string, port int) string {
+	if port == 0 {
+		port = 22
+	}
+	return knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// requestAddrs returns the known_hosts addresses of every host a deployment
+// connects to: the target, the cluster nodes and the jump host.
+func requestAddrs(req models.DeployRequest) []string {
+	addrs := []string{hostAddr(req.ServerIP, req.SSHPort)}
+	for _, node := range req.Nodes {
+		addrs = append(addrs, hostAddr(node.Host, req.SSHPort))
+	}
+	if req.JumpHost != "" {
+		addrs = append(addrs, hostAddr(req.JumpHost, req.JumpPort))
+	}
+	return addrs
+}
+
+// lookup returns the pinned key for addr, or nil if the host has not been seen.
+func (s *hostKeyStore) lookup(addr string) (ssh.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookupLocked(addr)
+}
+
+// lookupLocked is lookup for callers that hold s.mu.
+func (s *hostKeyStore) lookupLocked(addr string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	for len(bytes.TrimSpace(data)) > 0 {
+		_, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", s.path, err)
+		}
+		for _, h := range hosts {
+			if h == addr {
+				return key, nil
+			}
+		}
+		data = rest
+	}
+	return nil, nil
+}
+
+// add pins key for addr. Another deployment may have pinned the host since
+// its key was checked, so the file is read again first: the same key is not
+// added twice, and a different one is refused rather than shadowed.
+func (s *hostKeyStore) add(addr string, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pinned, err := s.lookupLocked(addr)
+	if err != nil {
+		return err
+	}
+	if pinned != nil {
+		if bytes.Equal(pinned.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return &SSHError{Code: SSHHostKeyChanged, Host: addr, Message: fmt.Sprintf(
+			"another deployment pinned host key %s in the meantime, not the confirmed %s; check the server and try again",
+			ssh.FingerprintSHA256(pinned), ssh.FingerprintSHA256(key))}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known hosts: %w", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(knownhosts.Line([]string{addr}, key) + "\n")
+	return err
+}
+
+// writeKnownHosts writes the pinned keys for addrs to path, for use as the
+// UserKnownHostsFile of a single deployment.
+func (s *hostKeyStore) writeKnownHosts(path string, addrs []string) error {
+	var buf bytes.Buffer
+	for _, addr := range addrs {
+		key, err := s.lookup(addr)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("host key for %s has not been confirmed", addr)
+		}
+		buf.WriteString(knownhosts.Line([]string{addr}, key) + "\n")
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// PinHostKeys records the keys of hosts seen for the first time, so later
+// connections must present the same key.
+func (d *Deployer) PinHostKeys(keys map[string]HostKey) error {
+	for addr, hk := range keys {
+		if hk.Known {
+			continue
+		}
+		if err := d.hostKeys.add(addr, hk.key); err != nil {
+			return fmt.Errorf("failed to pin host key for %s: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// verifyHostKey returns a callback that checks the server's key against the
+// pinned one for addr and records what was seen in hk, along with the host
+// key algorithms to negotiate so a pinned key is always the one offered.
+func (d *Deployer) verifyHostKey(host, addr string, hk *HostKey) (ssh.HostKeyCallback, []string, error) {
+	pinned, err := d.hostKeys.lookup(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var algorithms []string
+	if pinned != nil {
+		algorithms = []string{pinned.Type()}
+		if pinned.Type() == ssh.KeyAlgoRSA {
+			algorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+	}
+
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		hk.Fingerprint = ssh.FingerprintSHA256(key)
+		hk.key = key
+		if pinned == nil {
+			return nil
+		}
+		if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+			return &SSHError{Code: SSHHostKeyChanged, Host: host, Message: fmt.Sprintf(
+				"host key has changed (pinned %s, server offered %s); if the server was reinstalled, remove its entry from %s",
+				ssh.FingerprintSHA256(pinned), hk.Fingerprint, d.hostKeys.path)}
+		}
+		hk.Known = true
+		return nil
+	}, algorithms, nil
+}
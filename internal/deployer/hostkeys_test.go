@@ -0,0 +1,73 @@
+package deployer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyStoreAddRechecksPinnedKey(t *testing.T) {
+	s := &hostKeyStore{path: filepath.Join(t.TempDir(), "known_hosts")}
+	addr := hostAddr("192.0.2.10", 22)
+	key, other := newTestHostKey(t), newTestHostKey(t)
+
+	// Deployments that confirmed the same new host at once pin it once
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.add(addr, key)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("adding the same key: %v", err)
+		}
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Errorf("known_hosts has %d lines, want 1:\n%s", lines, data)
+	}
+
+	// A different key for a pinned host is refused and the pin kept
+	var sshErr *SSHError
+	if err := s.add(addr, other); !errors.As(err, &sshErr) || sshErr.Code != SSHHostKeyChanged {
+		t.Errorf("adding a different key for a pinned host: %v, want a host key changed error", err)
+	}
+	pinned, err := s.lookup(addr)
+	if err != nil || pinned == nil || !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+		t.Errorf("pinned key after a conflicting add = %v, %v", pinned, err)
+	}
+
+	// Other hosts are unaffected
+	if err := s.add(hostAddr("192.0.2.10", 2222), other); err != nil {
+		t.Errorf("adding a key for another port: %v", err)
+	}
+}
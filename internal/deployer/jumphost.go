@@ -0,0 +1,46 @@
+package deployer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"stackbill-deployer/internal/models"
+)
+
+// prepareJumpHost writes the bastion key into tmpDir and returns the
+// ProxyCommand option for ansible_ssh_common_args, or "" when no jump host is
+// configured. hostKeyOpts pins the bastion's host key like the target's.
+//
+// Without credentials the hop uses the agent or default keys. ProxyCommand is
+// used rather than ProxyJump because ProxyJump does not pass the known hosts
+// options on to the hop.
+func prepareJumpHost(tmpDir string, req models.DeployRequest, hostKeyOpts string) (string, error) {
+	if req.JumpHost == "" {
+		return "", nil
+	}
+
+	port := req.JumpPort
+	if port == 0 {
+		port = 22
+	}
+	target := fmt.Sprintf("%s@%s", req.JumpUser, req.JumpHost)
+
+	var proxy []string
+	switch {
+	case req.JumpKey != "":
+		keyPath := filepath.Join(tmpDir, "id_jump")
+		if err := writePrivateKey(keyPath, req.JumpKey, req.JumpKeyPassphrase); err != nil {
+			return "", fmt.Errorf("failed to write jump host key: %w", err)
+		}
+		proxy = append(proxy, "ssh", "-i", keyPath)
+	case req.JumpPass != "":
+		// sshpass -e reads the password from SSHPASS, set by secretEnv
+		proxy = append(proxy, "sshpass", "-e", "ssh")
+	default:
+		proxy = append(proxy, "ssh")
+	}
+	proxy = append(proxy, hostKeyOpts, "-p", fmt.Sprint(port), "-W", "%h:%p", target)
+
+	return fmt.Sprintf(`-o ProxyCommand="%s"`, strings.Join(proxy, " ")), nil
+}
@@ -0,0 +1,126 @@
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"stackbill-deployer/internal/models"
+)
+
+// preflightLogLines is how many trailing playbook output lines are kept to
+// explain a host that produced no results.
+const preflightLogLines = 5
+
+// Preflight runs the read-only requirement and connectivity checks from
+// preflight.yml against the target server (and any cluster nodes) and checks
+// the domain's DNS from the deployer. Nothing on the servers is changed.
+func (d *Deployer) Preflight(ctx context.Context, req models.DeployRequest) (*models.PreflightReport, error) {
+	tmpDir, err := os.MkdirTemp("", "sb-preflight-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	reportPath := filepath.Join(tmpDir, "report.json")
+	args, env, err := d.prepare(tmpDir, req, map[string]string{"preflight_report_path": reportPath}, func(string) {})
+	if err != nil {
+		return nil, err
+	}
+	args = append([]string{d.getPreflightPlaybookPath()}, args...)
+
+	var tailMu sync.Mutex // stdout and stderr are streamed concurrently
+	var tail []string
+	unreachable := make(map[string]string)
+	// Output ends up in the report, so secrets are masked as for deployments
+	onLog, onEvent := newRedactor(req, d.cfg.RedactPatterns).wrap(func(line string) {
+		tailMu.Lock()
+		tail = append(tail, line)
+		if len(tail) > preflightLogLines {
+			tail = tail[1:]
+		}
+		tailMu.Unlock()
+	}, func(event Event) {
+		if event.Type == EventUnreachable {
+			unreachable[event.Host] = event.Message
+		}
+	})
+	runErr := d.runPlaybook(ctx, args, env, onLog, onEvent)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("pre-flight checks timed out: %w", ctx.Err())
+	}
+
+	// Per-host checks written by the playbook; missing when every host failed
+	hostChecks := make(map[string][]models.PreflightCheck)
+	if data, err := os.ReadFile(reportPath); err == nil {
+		if err := json.Unmarshal(data, &hostChecks); err != nil {
+			return nil, fmt.Errorf("failed to parse pre-flight results: %w", err)
+		}
+	}
+
+	report := &models.PreflightReport{}
+	hosts := []string{req.ServerIP}
+	for _, node := range req.Nodes {
+		hosts = append(hosts, node.Host)
+	}
+	for _, host := range hosts {
+		checks, ok := hostChecks[host]
+		switch {
+		case unreachable[host] != "":
+			report.Add(models.PreflightCheck{Host: host, Category: "ssh", Name: "SSH connection",
+				Status: models.PreflightFail, Message: unreachable[host]})
+		case !ok:
+			msg := "no results were returned"
+			if runErr != nil && len(tail) > 0 {
+				msg = strings.Join(tail, " | ")
+			}
+			report.Add(models.PreflightCheck{Host: host, Category: "ssh", Name: "SSH connection",
+				Status: models.PreflightFail, Message: msg})
+		default:
+			report.Add(models.PreflightCheck{Host: host, Category: "ssh", Name: "SSH connection",
+				Status: models.PreflightPass, Message: "connected as " + req.SSHUser})
+			for _, check := range checks {
+				check.Host = host
+				report.Add(check)
+			}
+		}
+	}
+
+	report.Add(checkDomainDNS(ctx, req))
+	return report, nil
+}
+
+// checkDomainDNS verifies that the domain resolves to the target server.
+// Let's Encrypt needs this to issue the certificate; with a custom
+// certificate a mismatch is only a warning.
+func checkDomainDNS(ctx context.Context, req models.DeployRequest) models.PreflightCheck {
+	check := models.PreflightCheck{Category: "dns", Name: "DNS for " + req.Domain}
+	missing := models.PreflightWarn
+	if req.SSLMode == "letsencrypt" {
+		missing = models.PreflightFail
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, req.Domain)
+	if err != nil || len(addrs) == 0 {
+		check.Status = missing
+		check.Message = "domain does not resolve"
+		return check
+	}
+	for _, addr := range addrs {
+		if addr == req.ServerIP {
+			check.Status = models.PreflightPass
+			check.Message = "resolves to " + req.ServerIP
+			return check
+		}
+	}
+	// The server may sit behind NAT or a load balancer, so a different address
+	// is not necessarily wrong
+	check.Status = models.PreflightWarn
+	check.Message = fmt.Sprintf("resolves to %s, not %s (fine if the server is behind NAT)", strings.Join(addrs, ", "), req.ServerIP)
+	return check
+}
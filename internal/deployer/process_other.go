@@ -0,0 +1,16 @@
+//go:build !unix
+
+package deployer
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the ansible-playbook process itself.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
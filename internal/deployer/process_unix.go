@@ -0,0 +1,21 @@
+//go:build unix
+
+package deployer
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command as the leader of a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup sends SIGKILL to every process in the command's group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
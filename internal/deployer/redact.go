@@ -0,0 +1,158 @@
+package deployer
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"stackbill-deployer/internal/models"
+)
+
+// redactMask replaces secrets in log lines.
+const redactMask = "********"
+
+// minSecretLen is the shortest secret that is masked wherever it appears.
+// Shorter secrets are only masked where they stand alone, since masking them
+// everywhere would blank out parts of ordinary words throughout the log.
+const minSecretLen = 4
+
+// redactor masks known secrets and configured patterns in log lines before
+// they reach any sink (SSE, log store, server log).
+type redactor struct {
+	mu       sync.RWMutex
+	secrets  []string // Longest first, so a secret containing another is masked whole
+	short    []string // Secrets shorter than minSecretLen
+	patterns []*regexp.Regexp
+}
+
+// newRedactor returns a redactor for the secrets of req plus patterns.
+// Passwords generated during the run are added from EventSecret events.
+func newRedactor(req models.DeployRequest, patterns []*regexp.Regexp) *redactor {
+	r := &redactor{patterns: patterns}
+	for _, secret := range []string{
+		req.SSHPass, req.SSHKeyPassphrase, req.JumpPass, req.JumpKeyPassphrase,
+		req.ECRToken, req.SSLKey, req.SSHKey, req.JumpKey,
+	} {
+		r.add(secret)
+	}
+	return r
+}
+
+// add registers a secret. Multi-line secrets such as private keys are masked
+// line by line, since the log is streamed one line at a time.
+func (r *redactor) add(secret string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, line := range strings.Split(secret, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-----") {
+			// PEM armour lines are not secret
+			continue
+		}
+		if len(line) < minSecretLen {
+			r.short = append(r.short, line)
+			continue
+		}
+		r.secrets = append(r.secrets, line)
+	}
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+// redact returns line with every secret and pattern match masked. For
+// patterns with capture groups only the groups are masked, so a pattern like
+// `password=(\S+)` keeps the key visible.
+func (r *redactor) redact(line string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, secret := range r.secrets {
+		line = strings.ReplaceAll(line, secret, redactMask)
+	}
+	for _, secret := range r.short {
+		line = maskStandalone(line, secret)
+	}
+	for _, re := range r.patterns {
+		line = maskPattern(re, line)
+	}
+	return line
+}
+
+// maskStandalone masks the occurrences of secret in line that are not part
+// of a longer word: neither preceded nor followed by a letter or digit.
+func maskStandalone(line, secret string) string {
+	var sb strings.Builder
+	for {
+		i := strings.Index(line, secret)
+		if i < 0 {
+			break
+		}
+		end := i + len(secret)
+		if (i > 0 && isWordByte(line[i-1])) || (end < len(line) && isWordByte(line[end])) {
+			sb.WriteString(line[:i+1])
+			line = line[i+1:]
+			continue
+		}
+		sb.WriteString(line[:i])
+		sb.WriteString(redactMask)
+		line = line[end:]
+	}
+	sb.WriteString(line)
+	return sb.String()
+}
+
+// isWordByte reports whether b belongs to a word: an ASCII letter, digit or
+// underscore, or any byte of a non-ASCII character.
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 0x80 || (b >= '0' && b <= '9') || (b|0x20 >= 'a' && b|0x20 <= 'z')
+}
+
+func maskPattern(re *regexp.Regexp, line string) string {
+	matches := re.FindAllStringSubmatchIndex(line, -1)
+	if matches == nil {
+		return line
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, m := range matches {
+		spans := [][2]int{{m[0], m[1]}}
+		if len(m) > 2 {
+			spans = spans[:0]
+			for g := 2; g < len(m); g += 2 {
+				if m[g] >= 0 {
+					spans = append(spans, [2]int{m[g], m[g+1]})
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last || span[0] == span[1] {
+				continue // Nested group already masked, or nothing to mask
+			}
+			sb.WriteString(line[last:span[0]])
+			sb.WriteString(redactMask)
+			last = span[1]
+		}
+	}
+	sb.WriteString(line[last:])
+	return sb.String()
+}
+
+// wrap returns callbacks that mask secrets before calling onLog and onEvent,
+// and that pick up secrets announced by the callback plugin.
+func (r *redactor) wrap(onLog LogCallback, onEvent EventCallback) (LogCallback, EventCallback) {
+	redactLog := func(line string) {
+		onLog(r.redact(line))
+	}
+	redactEvent := func(event Event) {
+		if event.Type == EventSecret {
+			r.add(event.Value)
+			return
+		}
+		event.Message = r.redact(event.Message)
+		event.Task = r.redact(event.Task)
+		onEvent(event)
+	}
+	return redactLog, redactEvent
+}
@@ -0,0 +1,48 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"stackbill-deployer/internal/models"
+)
+
+// Environment variables that carry secrets to ansible-playbook. The inventory
+// and extra vars refer to them through env lookups, so no password or token
+// is written to the per-deployment temp files.
+const (
+	envSSHPass  = "SB_SSH_PASS"
+	envECRToken = "SB_ECR_TOKEN"
+	envSSLKey   = "SB_SSL_KEY"
+	envJumpPass = "SSHPASS" // Read by sshpass -e in the jump host ProxyCommand
+)
+
+// secretEnv returns the environment entries holding the request's secrets.
+func secretEnv(req models.DeployRequest) []string {
+	env := []string{envECRToken + "=" + req.ECRToken}
+	if req.SSHPass != "" {
+		env = append(env, envSSHPass+"="+req.SSHPass)
+	}
+	if req.SSLMode == "custom" {
+		env = append(env, envSSLKey+"="+req.SSLKey)
+	}
+	if req.JumpPass != "" {
+		env = append(env, envJumpPass+"="+req.JumpPass)
+	}
+	return env
+}
+
+// envLookup returns a Jinja expression that reads the environment variable name.
+func envLookup(name string) string {
+	return fmt.Sprintf(`{{ lookup("env", "%s") }}`, name)
+}
+
+// iniQuote quotes an inventory host variable value. Ansible splits INI host
+// lines like a POSIX shell, so any value with spaces, quotes, '=' or '#' is
+// single-quoted, with embedded single quotes escaped the shell way.
+func iniQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t'\"\\=#;$`") {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,310 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"stackbill-deployer/internal/models"
+)
+
+// SSH check error codes, returned to API clients in the "code" field.
+const (
+	SSHAuthFailed        = "auth_failed"
+	SSHTimeout           = "timeout"
+	SSHConnectionRefused = "connection_refused"
+	SSHUnreachable       = "unreachable"
+	SSHNoSudo            = "no_sudo"
+	SSHInvalidKey        = "invalid_key"
+	SSHHostKeyChanged    = "host_key_changed"
+)
+
+// sshCheckTimeout bounds each connection attempt, including the sudo check.
+const sshCheckTimeout = 15 * time.Second
+
+// SSHError describes why a host failed the SSH check.
+type SSHError struct {
+	Code    string // One of the SSH* error codes
+	Host    string
+	Message string
+}
+
+func (e *SSHError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Host, e.Message)
+}
+
+// CheckSSH connects to the target server and every cluster node with the
+// request's credentials (through the jump host, if any) and verifies that
+// non-root users can become root with sudo. It returns the host key of every
+// host contacted, keyed by known_hosts address. A key that differs from the
+// pinned one fails the check. Failures are returned as *SSHError.
+func (d *Deployer) CheckSSH(ctx context.Context, req models.DeployRequest) (map[string]HostKey, error) {
+	targetAuth, err := targetAuthMethods(req)
+	if err != nil {
+		return nil, &SSHError{Code: SSHInvalidKey, Host: req.ServerIP, Message: err.Error()}
+	}
+
+	keys := make(map[string]HostKey)
+	var jump *ssh.Client
+	if req.JumpHost != "" {
+		var hk HostKey
+		jump, err = d.dialJumpHost(ctx, req, &hk)
+		if err != nil {
+			return nil, err
+		}
+		defer jump.Close()
+		keys[hostAddr(req.JumpHost, req.JumpPort)] = hk
+	}
+
+	hosts := []string{req.ServerIP}
+	for _, node := range req.Nodes {
+		hosts = append(hosts, node.Host)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make([]error, len(hosts))
+	)
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hk, err := d.checkHost(ctx, jump, host, req, targetAuth)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			mu.Lock()
+			keys[hostAddr(host, req.SSHPort)] = hk
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Report the first failing host in request order
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// checkHost opens an SSH session to host, runs the sudo check and returns
+// the host key.
+func (d *Deployer) checkHost(ctx context.Context, jump *ssh.Client, host string, req models.DeployRequest, auth []ssh.AuthMethod) (HostKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshCheckTimeout)
+	defer cancel()
+
+	port := req.SSHPort
+	if port == 0 {
+		port = 22
+	}
+	var hk HostKey
+	callback, algorithms, err := d.verifyHostKey(host, hostAddr(host, port), &hk)
+	if err != nil {
+		return hk, err
+	}
+	client, err := dialSSH(ctx, jump, host, port, &ssh.ClientConfig{
+		User:              req.SSHUser,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algorithms,
+	})
+	if err != nil {
+		return hk, err
+	}
+	defer client.Close()
+
+	if req.SSHUser != "root" {
+		if err := checkSudo(ctx, client, host, req); err != nil {
+			return hk, err
+		}
+	}
+	return hk, nil
+}
+
+// checkSudo verifies that the user can run commands as root, either without a
+// password or with the SSH password (Ansible uses it as the become password).
+func checkSudo(ctx context.Context, client *ssh.Client, host string, req models.DeployRequest) error {
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	err := runSSH(client, "sudo -n true", "")
+	if err != nil && req.SSHPass != "" {
+		err = runSSH(client, "sudo -S -p '' true", req.SSHPass+"\n")
+	}
+	if ctx.Err() != nil {
+		return &SSHError{Code: SSHTimeout, Host: host, Message: "timed out checking sudo access"}
+	}
+	if err == nil {
+		return nil
+	}
+
+	msg := fmt.Sprintf("user %s cannot run sudo", req.SSHUser)
+	if req.SSHPass == "" {
+		msg += " without a password; configure passwordless sudo or provide ssh_pass"
+	}
+	return &SSHError{Code: SSHNoSudo, Host: host, Message: msg}
+}
+
+// runSSH runs cmd in a new session, feeding it stdin.
+func runSSH(client *ssh.Client, cmd, stdin string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(stdin)
+	return session.Run(cmd)
+}
+
+// dialJumpHost connects to the bastion, recording its host key in hk. Without
+// a password or key it falls back to the local SSH agent, as Ansible does.
+func (d *Deployer) dialJumpHost(ctx context.Context, req models.DeployRequest, hk *HostKey) (*ssh.Client, error) {
+	var auth []ssh.AuthMethod
+	switch {
+	case req.JumpKey != "":
+		signer, err := parseSigner(req.JumpKey, req.JumpKeyPassphrase)
+		if err != nil {
+			return nil, &SSHError{Code: SSHInvalidKey, Host: req.JumpHost, Message: "jump host key: " + err.Error()}
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	case req.JumpPass != "":
+		auth = append(auth, passwordAuth(req.JumpPass)...)
+	default:
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				defer conn.Close()
+				auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+	}
+
+	port := req.JumpPort
+	if port == 0 {
+		port = 22
+	}
+	callback, algorithms, err := d.verifyHostKey(req.JumpHost, hostAddr(req.JumpHost, port), hk)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sshCheckTimeout)
+	defer cancel()
+	client, err := dialSSH(ctx, nil, req.JumpHost, port, &ssh.ClientConfig{
+		User:              req.JumpUser,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algorithms,
+	})
+	if err != nil {
+		var sshErr *SSHError
+		if errors.As(err, &sshErr) {
+			sshErr.Message = "jump host: " + sshErr.Message
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialSSH connects to host:port directly or through jump and completes the
+// SSH handshake, classifying failures into SSHError codes.
+func dialSSH(ctx context.Context, jump *ssh.Client, host string, port int, config *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var conn net.Conn
+	var err error
+	if jump != nil {
+		conn, err = jump.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, classifyDialError(ctx, host, err)
+	}
+
+	// The handshake has no context of its own
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		var sshErr *SSHError
+		switch {
+		case errors.As(err, &sshErr):
+			// Rejected by the host key callback
+			return nil, sshErr
+		case ctx.Err() != nil:
+			return nil, &SSHError{Code: SSHTimeout, Host: host, Message: "timed out during SSH handshake"}
+		case strings.Contains(err.Error(), "unable to authenticate"):
+			return nil, &SSHError{Code: SSHAuthFailed, Host: host,
+				Message: fmt.Sprintf("authentication failed for user %s", config.User)}
+		}
+		return nil, &SSHError{Code: SSHUnreachable, Host: host, Message: err.Error()}
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func classifyDialError(ctx context.Context, host string, err error) error {
+	var netErr net.Error
+	switch {
+	case ctx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout():
+		return &SSHError{Code: SSHTimeout, Host: host, Message: "connection timed out"}
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(strings.ToLower(err.Error()), "connection refused"):
+		// The second form is how a jump host reports a refused forward
+		return &SSHError{Code: SSHConnectionRefused, Host: host, Message: "connection refused"}
+	}
+	return &SSHError{Code: SSHUnreachable, Host: host, Message: err.Error()}
+}
+
+// targetAuthMethods returns the auth methods for the target server and nodes.
+func targetAuthMethods(req models.DeployRequest) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	if req.SSHKey != "" {
+		signer, err := parseSigner(req.SSHKey, req.SSHKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if req.SSHPass != "" {
+		auth = append(auth, passwordAuth(req.SSHPass)...)
+	}
+	return auth, nil
+}
+
+// passwordAuth offers the password both as "password" and
+// "keyboard-interactive", since many servers only enable the latter.
+func passwordAuth(password string) []ssh.AuthMethod {
+	return []ssh.AuthMethod{
+		ssh.Password(password),
+		ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}),
+	}
+}
+
+func parseSigner(key, passphrase string) (ssh.Signer, error) {
+	raw, err := ParsePrivateKey(key, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(raw)
+}
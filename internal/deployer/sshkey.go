@@ -0,0 +1,38 @@
+package deployer
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParsePrivateKey parses a PEM-encoded SSH private key, decrypting it with
+// passphrase when the key is encrypted.
+func ParsePrivateKey(key, passphrase string) (interface{}, error) {
+	if passphrase != "" {
+		return ssh.ParseRawPrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+	}
+	raw, err := ssh.ParseRawPrivateKey([]byte(key))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("private key is encrypted; a passphrase is required")
+	}
+	return raw, err
+}
+
+// writePrivateKey writes the decrypted private key to path with 0600 permissions,
+// so ansible-playbook can use it without prompting for a passphrase.
+func writePrivateKey(path, key, passphrase string) error {
+	raw, err := ParsePrivateKey(key, passphrase)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
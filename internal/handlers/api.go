@@ -1,23 +1,36 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"stackbill-deployer/internal/audit"
+	"stackbill-deployer/internal/auth"
 	"stackbill-deployer/internal/config"
+	"stackbill-deployer/internal/credstore"
 	"stackbill-deployer/internal/deployer"
+	"stackbill-deployer/internal/logstore"
 	"stackbill-deployer/internal/models"
+	"stackbill-deployer/internal/queue"
+	"stackbill-deployer/internal/ratelimit"
+	"stackbill-deployer/internal/stages"
+	"stackbill-deployer/internal/store"
 
 	"github.com/gorilla/mux"
 )
@@ -27,35 +40,77 @@ var (
 	validIDRegex      = regexp.MustCompile(`^[a-zA-Z0-9\-]+$`)
 	validDomainRegex  = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?)*$`)
 	validVersionRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+	validChartRegex   = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+)*(-[0-9A-Za-z.\-]+)?$`)
+	validUserRegex    = regexp.MustCompile(`^[a-zA-Z0-9._\-]+$`)
+	validTokenName    = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@\-]{0,63}$`)
+	validTokenID      = regexp.MustCompile(`^[a-f0-9]{16}$`)
+	validSubject      = regexp.MustCompile(`^(token:[a-f0-9]{16}|oidc:[\x21-\x7e]{1,255})$`)
 )
 
-// SSEEvent represents a server-sent event with a type and data payload.
-type SSEEvent struct {
-	Type string // "log", "stage", or "done"
-	Data string // JSON or plain text payload
-}
+// maxViewers caps how many subjects a deployment can be shared with.
+const maxViewers = 50
 
 type APIHandler struct {
-	cfg           *config.Config
-	deployer      *deployer.Deployer
-	deployments   map[string]*models.Deployment
-	mu            sync.RWMutex
-	subscribers   map[string][]chan SSEEvent
-	subMu         sync.Mutex
-	activeServers map[string]bool // Prevent concurrent deploys to same server
-	serverMu      sync.Mutex
-	lastDeploy    time.Time // Simple rate limiting
-	stateDirty    bool      // Marks state as needing persistence
-}
-
-func NewAPIHandler(cfg *config.Config) *APIHandler {
+	cfg         *config.Config
+	deployer    *deployer.Deployer
+	stages      *stages.Manifest
+	deployments map[string]*models.Deployment
+	cancels     map[string]context.CancelFunc // Cancel funcs for in-flight deployments
+	mu          sync.RWMutex
+	subscribers map[string][]chan struct{} // Wake-up signals for SSE clients
+	subMu       sync.Mutex
+	queue       *queue.Queue  // Runs deployments, one at a time per host
+	preflights  chan struct{} // Limits concurrent pre-flight checks
+	store       store.Store
+	logs        *logstore.Store
+	creds       *credstore.Store          // Generated credentials of successful deployments
+	tokens      *auth.TokenStore          // Named API tokens
+	sessions    *auth.SessionStore        // Browser login sessions
+	oidc        *auth.OIDC                // Single sign-on provider; nil when not configured
+	audit       *audit.Log                // Record of who did what
+	deployLimit *ratelimit.Limiter        // Deployment requests per client IP and per token
+	authLockout *ratelimit.Lockout        // Client IPs and invalid tokens failing too many token checks
+	ssoLimit    *ratelimit.Limiter        // SSO logins started per client IP
+	recentLogs  map[string]*logstore.Ring // In-memory tail of each running deployment's log
+	dirty       map[string]bool           // Deployments needing persistence
+}
+
+// recentLogLines is how many log lines of a running deployment are kept in memory.
+const recentLogLines = 500
+
+// preflightTimeout bounds a pre-flight run, including unreachable hosts.
+const preflightTimeout = 3 * time.Minute
+
+// ssoLoginsPerMinute limits how many SSO logins one client IP may start; each
+// holds server memory until it completes or times out.
+const ssoLoginsPerMinute = 10
+
+// maxClusterNodes limits the additional K3s nodes a deployment may list.
+const maxClusterNodes = 20
+
+func NewAPIHandler(cfg *config.Config, manifest *stages.Manifest, st store.Store, logs *logstore.Store, creds *credstore.Store, tokens *auth.TokenStore, oidc *auth.OIDC, auditLog *audit.Log) *APIHandler {
 	h := &APIHandler{
-		cfg:           cfg,
-		deployer:      deployer.New(cfg),
-		deployments:   make(map[string]*models.Deployment),
-		subscribers:   make(map[string][]chan SSEEvent),
-		activeServers: make(map[string]bool),
+		cfg:         cfg,
+		deployer:    deployer.New(cfg),
+		stages:      manifest,
+		deployments: make(map[string]*models.Deployment),
+		cancels:     make(map[string]context.CancelFunc),
+		subscribers: make(map[string][]chan struct{}),
+		preflights:  make(chan struct{}, cfg.Workers),
+		store:       st,
+		logs:        logs,
+		creds:       creds,
+		tokens:      tokens,
+		sessions:    auth.NewSessionStore(cfg.SessionTTL),
+		oidc:        oidc,
+		audit:       auditLog,
+		deployLimit: ratelimit.New(cfg.RateLimit.DeployPerMinute, cfg.RateLimit.DeployBurst),
+		authLockout: ratelimit.NewLockout(cfg.RateLimit.AuthPerMinute, cfg.RateLimit.AuthFailures, cfg.RateLimit.AuthLockout),
+		ssoLimit:    ratelimit.New(ssoLoginsPerMinute, ssoLoginsPerMinute),
+		recentLogs:  make(map[string]*logstore.Ring),
+		dirty:       make(map[string]bool),
 	}
+	h.queue = queue.New(cfg.Workers, cfg.MaxQueued, h.notifyQueued)
 	h.loadState()
 	go h.periodicSave()
 	return h
@@ -65,27 +120,18 @@ func NewAPIHandler(cfg *config.Config) *APIHandler {
 // STATE PERSISTENCE
 // ==========================================
 
-func (h *APIHandler) stateFile() string {
-	return filepath.Join(h.cfg.DataDir, "state.json")
-}
-
-// loadState restores deployment state from disk on startup.
+// loadState restores deployment state from the store on startup.
 // Deployments that were running when the server stopped are marked as interrupted.
 func (h *APIHandler) loadState() {
-	data, err := os.ReadFile(h.stateFile())
+	deps, err := h.store.Load()
 	if err != nil {
-		return // No state file yet — fresh start
-	}
-
-	var deps map[string]*models.Deployment
-	if err := json.Unmarshal(data, &deps); err != nil {
-		log.Printf("Warning: could not parse state file: %v", err)
+		log.Printf("Warning: could not load deployments: %v", err)
 		return
 	}
 
-	for id, dep := range deps {
+	for _, dep := range deps {
 		// Mark deployments that were active when the server stopped
-		if dep.Status == models.StatusRunning || dep.Status == models.StatusPending {
+		if dep.Status == models.StatusRunning || dep.Status == models.StatusPending || dep.Status == models.StatusQueued {
 			dep.Status = models.StatusInterrupted
 			now := time.Now()
 			dep.EndedAt = &now
@@ -94,59 +140,135 @@ func (h *APIHandler) loadState() {
 					dep.Stages[i].Status = "interrupted"
 				}
 			}
+			h.dirty[dep.ID] = true
 		}
-		h.deployments[id] = dep
+		h.migrateOwner(dep)
+		h.deployments[dep.ID] = dep
 	}
 
 	if len(deps) > 0 {
-		log.Printf("Restored %d deployment(s) from state file", len(deps))
+		log.Printf("Restored %d deployment(s) from store", len(deps))
+	}
+}
+
+// migrateOwner moves a deployment recorded before owners were subjects onto
+// the subject of the identity that started it. Token names can be reused
+// after a revoke, so a name only maps to a token that already existed when
+// the deployment started; anything else is left for admins.
+// Caller must hold h.mu or own dep exclusively.
+func (h *APIHandler) migrateOwner(dep *models.Deployment) {
+	owner := dep.Owner
+	if owner == "" {
+		owner = dep.CreatedBy
+	}
+	if owner == "" || owner == "admin" || strings.HasPrefix(owner, "token:") || strings.HasPrefix(owner, "oidc:") {
+		if dep.Owner != owner {
+			dep.Owner = owner
+			h.dirty[dep.ID] = true
+		}
+		return
+	}
+	dep.Owner = ""
+	for _, t := range h.tokens.List() {
+		if t.Name == owner && !t.CreatedAt.After(dep.StartedAt) {
+			dep.Owner = auth.TokenSubject(t.ID)
+		}
 	}
+	h.dirty[dep.ID] = true
 }
 
-// markDirty flags the state as needing to be written to disk.
-func (h *APIHandler) markDirty() {
+// markDirty flags a deployment as needing to be written to the store.
+func (h *APIHandler) markDirty(id string) {
 	h.mu.Lock()
-	h.stateDirty = true
+	h.dirty[id] = true
 	h.mu.Unlock()
 }
 
-// periodicSave writes state to disk every 5 seconds if dirty.
-func (h *APIHandler) periodicSave() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		h.mu.Lock()
-		dirty := h.stateDirty
-		h.stateDirty = false
-		h.mu.Unlock()
-
-		if dirty {
-			h.saveState()
-		}
+// appendLog writes a log line to the deployment's log file and in-memory tail.
+// Caller must hold h.mu.
+func (h *APIHandler) appendLog(dep *models.Deployment, line string) {
+	count, err := h.logs.Append(dep.ID, line)
+	if err != nil {
+		log.Printf("Failed to write log for %s: %v", dep.ID, err)
+		return
+	}
+	ring, ok := h.recentLogs[dep.ID]
+	if !ok {
+		ring = logstore.NewRing(recentLogLines, dep.LogCount)
+		h.recentLogs[dep.ID] = ring
 	}
+	ring.Add(line)
+	dep.LogCount = count
+	h.dirty[dep.ID] = true
 }
 
-// saveState writes all deployment state to disk.
-func (h *APIHandler) saveState() {
+// eachLog calls fn for log lines [from, to) of a deployment, reading from the
+// in-memory tail when it still holds them and from disk otherwise.
+func (h *APIHandler) eachLog(id string, from, to int, fn func(line string) error) error {
 	h.mu.RLock()
-	data, err := json.Marshal(h.deployments)
+	if ring, ok := h.recentLogs[id]; ok {
+		if lines, ok := ring.Since(from); ok {
+			h.mu.RUnlock()
+			for i := 0; i < len(lines) && from+i < to; i++ {
+				if err := fn(lines[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
 	h.mu.RUnlock()
 
-	if err != nil {
-		log.Printf("Failed to marshal state: %v", err)
-		return
+	errDone := errors.New("done")
+	err := h.logs.Read(id, from, func(index int, line string) error {
+		if index >= to {
+			return errDone
+		}
+		return fn(line)
+	})
+	if err == errDone {
+		return nil
 	}
+	return err
+}
 
-	if err := os.WriteFile(h.stateFile(), data, 0600); err != nil {
-		log.Printf("Failed to save state: %v", err)
+// periodicSave flushes dirty deployments every 5 seconds.
+func (h *APIHandler) periodicSave() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.saveState()
 	}
 }
 
-// saveStateNow writes state immediately (used for critical transitions).
-func (h *APIHandler) saveStateNow() {
+// saveState writes every dirty deployment to the store.
+func (h *APIHandler) saveState() {
+	// Snapshot under the lock, write outside it
 	h.mu.Lock()
-	h.stateDirty = false
+	var saves []models.Deployment
+	for id := range h.dirty {
+		dep, ok := h.deployments[id]
+		if !ok {
+			continue
+		}
+		snapshot := *dep
+		snapshot.Stages = append([]models.Stage(nil), dep.Stages...)
+		saves = append(saves, snapshot)
+	}
+	h.dirty = make(map[string]bool)
 	h.mu.Unlock()
+
+	for i := range saves {
+		if err := h.store.Save(&saves[i]); err != nil {
+			log.Printf("Failed to save deployment %s: %v", saves[i].ID, err)
+			h.markDirty(saves[i].ID) // Retry on the next save
+		}
+	}
+}
+
+// saveStateNow writes a deployment immediately (used for critical transitions).
+func (h *APIHandler) saveStateNow(id string) {
+	h.markDirty(id)
 	h.saveState()
 }
 
@@ -154,30 +276,399 @@ func (h *APIHandler) saveStateNow() {
 // AUTH & SECURITY
 // ==========================================
 
-// AuthMiddleware validates the bearer token on API routes.
+// identityKey is the request context key of the authenticated auth.Identity.
+type identityKey struct{}
+
+// sessionCookie holds the browser session ID set by Login.
+const sessionCookie = "sb_session"
+
+// oidcStateCookie holds the state of the SSO login started by this browser,
+// so a callback carrying someone else's state is refused.
+const oidcStateCookie = "sb_oidc_state"
+
+// AuthMiddleware authenticates API requests by bearer token or session
+// cookie and attaches the caller's identity to the request context. Cookie
+// sessions must also send their CSRF token on mutating requests; bearer
+// tokens are never sent automatically by the browser, so they need none.
 func (h *APIHandler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-
-		// Check Authorization header first
-		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
-			token = strings.TrimPrefix(auth, "Bearer ")
-		}
+		var id auth.Identity
+		ok := false
 
-		// Fallback: query parameter (required for EventSource which can't set headers)
-		if token == "" {
-			token = r.URL.Query().Get("token")
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token := strings.TrimPrefix(header, "Bearer ")
+			if h.lockedOut(w, r, apiRealm, token) {
+				return
+			}
+			if id, ok = h.authenticate(token); !ok {
+				h.record(audit.Entry{SourceIP: clientIP(r), Action: "auth", Outcome: audit.OutcomeDenied,
+					Status: http.StatusUnauthorized, Detail: "invalid bearer token for " + r.Method + " " + r.URL.Path})
+				h.authFailed(r, apiRealm, token)
+			}
+		} else if cookie, err := r.Cookie(sessionCookie); err == nil {
+			var session auth.Session
+			if session, ok = h.sessions.Get(cookie.Value); ok {
+				id = session.Identity
+				if !safeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CSRF-Token")), []byte(session.CSRFToken)) != 1 {
+					http.Error(w, `{"error": "missing or invalid CSRF token"}`, http.StatusForbidden)
+					return
+				}
+			}
 		}
 
-		if token != h.cfg.AuthToken {
+		if !ok {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(`{"error": "invalid or missing auth token"}`))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// authenticate resolves an API token. The bootstrap token from the config
+// acts as a built-in admin token named "admin".
+func (h *APIHandler) authenticate(token string) (auth.Identity, bool) {
+	if token == "" {
+		return auth.Identity{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AuthToken)) == 1 {
+		return auth.Identity{Name: "admin", Scope: auth.ScopeAdmin, Subject: "admin"}, true
+	}
+	if t, ok := h.tokens.Authenticate(token); ok {
+		return auth.Identity{TokenID: t.ID, Name: t.Name, Scope: t.Scope, Subject: auth.TokenSubject(t.ID)}, true
+	}
+	return auth.Identity{}, false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// authRealm is a kind of token check with its own lockout counters, so
+// failing one kind never locks a client or a token out of another.
+type authRealm struct {
+	prefix string // Namespace of the realm's keys in authLockout
+	what   string // The tokens checked, for messages
+}
+
+var (
+	apiRealm         = authRealm{"", "tokens"}                         // API tokens: bearer and login
+	credentialsRealm = authRealm{"credentials:", "credentials tokens"} // X-Credentials-Token
+)
+
+// authKeys returns the lockout keys of a token check: the client IP, so one
+// address cannot try many tokens, and a hash of the presented token, so one
+// token cannot be retried from many addresses. There is no token key for an
+// empty token, which would otherwise be one counter shared by every client.
+func authKeys(r *http.Request, realm authRealm, token string) (ipKey, tokenKey string) {
+	ipKey = realm.prefix + "ip:" + clientIP(r)
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		tokenKey = realm.prefix + "token:" + hex.EncodeToString(sum[:])
+	}
+	return ipKey, tokenKey
+}
+
+// lockedOut refuses the request with 429 if the client, or the token it
+// presents, has failed too many checks in realm recently. Only token checks
+// are refused; existing sessions from the same address keep working.
+func (h *APIHandler) lockedOut(w http.ResponseWriter, r *http.Request, realm authRealm, token string) bool {
+	ipKey, tokenKey := authKeys(r, realm, token)
+	if wait, locked := h.authLockout.Locked(ipKey); locked {
+		tooManyRequests(w, wait, "too many invalid "+realm.what+" from this address, try again later")
+		return true
+	}
+	if tokenKey == "" {
+		return false
+	}
+	if wait, locked := h.authLockout.Locked(tokenKey); locked {
+		tooManyRequests(w, wait, "this token was rejected too many times, try again later")
+		return true
+	}
+	return false
+}
+
+// authFailed counts an invalid token against the client and against the
+// token, locking either out of realm once it has failed too often.
+func (h *APIHandler) authFailed(r *http.Request, realm authRealm, token string) {
+	ip := clientIP(r)
+	ipKey, tokenKey := authKeys(r, realm, token)
+	lockout := h.cfg.RateLimit.AuthLockout.String()
+	if h.authLockout.Fail(ipKey) {
+		log.Printf("Locking out %s for %s after repeated invalid %s", ip, lockout, realm.what)
+		h.record(audit.Entry{SourceIP: ip, Action: "lockout", Outcome: audit.OutcomeDenied,
+			Detail: "address locked out for " + lockout + " after repeated invalid " + realm.what})
+	}
+	if tokenKey != "" && h.authLockout.Fail(tokenKey) {
+		log.Printf("Locking out a token for %s after it was rejected repeatedly as one of the %s (last from %s)", lockout, realm.what, ip)
+		h.record(audit.Entry{SourceIP: ip, Action: "lockout", Outcome: audit.OutcomeDenied,
+			Detail: "token locked out of " + realm.what + " for " + lockout + " after repeated rejections"})
+	}
+}
+
+// RateLimit wraps a deployment endpoint so each client IP and each token can
+// only start a limited number of requests per minute; one busy user cannot
+// starve the others.
+func (h *APIHandler) RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := h.deployLimit.Allow("ip:"+clientIP(r), "token:"+identity(r).Subject); !ok {
+			tooManyRequests(w, wait, "too many deployment requests, slow down")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// tooManyRequests replies 429 with a Retry-After header in whole seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	jsonError(w, fmt.Sprintf("%s (retry in %ds)", msg, secs), http.StatusTooManyRequests)
+}
+
+// Login exchanges an API token for an HttpOnly session cookie, so the browser
+// never has to put the token in a URL. The response carries the CSRF token
+// the client must send in the X-CSRF-Token header on mutating requests.
+func (h *APIHandler) Login(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if h.lockedOut(w, r, apiRealm, req.Token) {
+		return
+	}
+	id, ok := h.authenticate(req.Token)
+	if !ok {
+		log.Printf("Failed login from %s", r.RemoteAddr)
+		h.authFailed(r, apiRealm, req.Token)
+		http.Error(w, `{"error": "invalid access token"}`, http.StatusUnauthorized)
+		return
+	}
+	auditNote(r).actor = id.Name
+
+	session, err := h.sessions.Create(id)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		http.Error(w, `{"error": "failed to create session"}`, http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, session)
+	writeSession(w, session)
+}
+
+// OIDCLogin starts single sign-on by redirecting the browser to the provider.
+// The login's state is also set in a cookie that the callback checks.
+func (h *APIHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if ok, _ := h.ssoLimit.Allow(clientIP(r)); !ok {
+		redirectLoginError(w, r, "Too many sign-in attempts from this address; try again in a minute")
+		return
+	}
+	authURL, state, err := h.oidc.AuthURL()
+	if errors.Is(err, auth.ErrTooManyLogins) {
+		redirectLoginError(w, r, "Sign-in failed: "+err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to start SSO login: %v", err)
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	// Lax, not Strict: the cookie must come back on the provider's
+	// cross-site redirect to the callback.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(auth.OIDCLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes single sign-on. The provider redirects the browser
+// here with an authorization code, which is exchanged for an ID token; the
+// user's groups decide the scope of the session. Errors are sent back to the
+// login page, which displays them.
+func (h *APIHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		Path:     "/auth/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
 	})
+	if err != nil || q.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(q.Get("state"))) != 1 {
+		log.Printf("Refused SSO callback from %s: state does not match this browser's login", r.RemoteAddr)
+		note := auditNote(r)
+		note.outcome, note.detail = audit.OutcomeDenied, "state does not match the login started by this browser"
+		redirectLoginError(w, r, "Sign-in failed: the login was not started in this browser; try again")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		msg := e
+		if desc := q.Get("error_description"); desc != "" {
+			msg += ": " + desc
+		}
+		note := auditNote(r)
+		note.outcome, note.detail = audit.OutcomeDenied, "rejected by provider: "+msg
+		redirectLoginError(w, r, "Sign-in was rejected by the provider ("+msg+")")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	id, err := h.oidc.Callback(ctx, q.Get("state"), q.Get("code"))
+	if err != nil {
+		log.Printf("Failed SSO login from %s: %v", r.RemoteAddr, err)
+		note := auditNote(r)
+		note.outcome, note.detail = audit.OutcomeDenied, err.Error()
+		redirectLoginError(w, r, "Sign-in failed: "+err.Error())
+		return
+	}
+
+	session, err := h.sessions.Create(id)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		auditNote(r).outcome = audit.OutcomeFailed
+		redirectLoginError(w, r, "Sign-in failed: could not create a session")
+		return
+	}
+	log.Printf("SSO login: %s (%s)", id.Name, id.Scope)
+	note := auditNote(r)
+	note.actor, note.detail = id.Name, "scope "+string(id.Scope)
+	setSessionCookie(w, r, session)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func redirectLoginError(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/?login_error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, session auth.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Session returns the current session, letting a reloaded page recover its
+// CSRF token. Bearer-token callers have no session.
+func (h *APIHandler) Session(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		http.Error(w, `{"error": "not logged in with a session"}`, http.StatusNotFound)
+		return
+	}
+	session, ok := h.sessions.Get(cookie.Value)
+	if !ok {
+		http.Error(w, `{"error": "not logged in with a session"}`, http.StatusNotFound)
+		return
+	}
+	writeSession(w, session)
+}
+
+// Logout ends the session and clears its cookie.
+func (h *APIHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		h.sessions.Delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeSession(w http.ResponseWriter, session auth.Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":       session.Identity.Name,
+		"subject":    session.Identity.Subject,
+		"scope":      session.Identity.Scope,
+		"csrf_token": session.CSRFToken,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+// RequireScope wraps an API handler so only tokens with at least scope may call it.
+func (h *APIHandler) RequireScope(scope auth.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !identity(r).Scope.Allows(scope) {
+			jsonError(w, fmt.Sprintf("this endpoint requires a token with the %s scope", scope), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// identity returns the caller set by AuthMiddleware.
+func identity(r *http.Request) auth.Identity {
+	id, _ := r.Context().Value(identityKey{}).(auth.Identity)
+	return id
+}
+
+// canView reports whether the caller may see dep. Admins see every
+// deployment; everyone else sees those they own or that were shared with them.
+func canView(id auth.Identity, dep *models.Deployment) bool {
+	if id.Scope == auth.ScopeAdmin {
+		return true
+	}
+	if !id.Scope.Valid() || id.Subject == "" {
+		return false
+	}
+	if dep.Owner == id.Subject {
+		return true
+	}
+	for _, v := range dep.Viewers {
+		if v == id.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// canAct reports whether the caller may resume, cancel or uninstall dep.
+// Admins may act on any deployment, deployers on their own.
+func canAct(id auth.Identity, dep *models.Deployment) bool {
+	switch id.Scope {
+	case auth.ScopeAdmin:
+		return true
+	case auth.ScopeDeploy:
+		return id.Subject != "" && dep.Owner == id.Subject
+	}
+	return false
+}
+
+// notFoundForeign answers a request for a deployment the caller may not access
+// as if it did not exist, so other users' deployment IDs cannot be probed.
+func notFoundForeign(w http.ResponseWriter, r *http.Request) {
+	note := auditNote(r)
+	note.outcome, note.detail = audit.OutcomeDenied, "deployment belongs to another user"
+	http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
 }
 
 // SecurityHeaders adds protective headers to all responses.
@@ -205,165 +696,559 @@ func (h *APIHandler) Deploy(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
 		return
 	}
+	auditNote(r).server = req.ServerIP
 
-	// --- Input validation ---
+	if err := validateDeployRequest(&req); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Server IP must be a valid IP address
-	if net.ParseIP(req.ServerIP) == nil {
-		http.Error(w, `{"error": "server_ip must be a valid IP address"}`, http.StatusBadRequest)
+	if req.ECRToken == "" {
+		http.Error(w, `{"error": "ecr_token is required"}`, http.StatusBadRequest)
 		return
 	}
 
-	if req.SSHUser == "" {
-		http.Error(w, `{"error": "ssh_user is required"}`, http.StatusBadRequest)
+	hostKeys, ok := h.checkSSH(w, r, req)
+	if !ok {
+		return
+	}
+
+	stageList := h.stages.Build(req)
+	if req.Type == models.DeployTypeUpgrade {
+		// Only the upgrade stages' roles run; the rest of the installation is left alone
+		for _, s := range stageList {
+			req.Roles = append(req.Roles, s.Role)
+		}
+	}
+
+	dep := &models.Deployment{
+		ID:           generateID(),
+		Request:      req,
+		Summary:      models.NewSummary(req),
+		Status:       models.StatusPending,
+		CreatedBy:    identity(r).Name,
+		Owner:        identity(r).Subject,
+		StartedAt:    time.Now(),
+		Stages:       stageList,
+		CurrentStage: -1,
+		Nodes:        models.BuildNodes(req),
+	}
+	dep.Summary.HostKeys = hostKeys
+
+	note := auditNote(r)
+	note.deploymentID, note.detail = dep.ID, dep.Summary.Type
+	h.startDeployment(w, dep)
+}
+
+// checkSSH connects to every host of the request natively before anything is
+// queued, so bad credentials or missing sudo access are rejected up front with
+// an error code instead of surfacing later as an Ansible failure.
+//
+// Host keys are pinned on first contact, but only once the user has confirmed
+// their fingerprints: until req.HostKeys lists them, the reply is 409 with code
+// "host_key_unconfirmed" and the fingerprints to show. It returns the pinned
+// fingerprints of all hosts.
+func (h *APIHandler) checkSSH(w http.ResponseWriter, r *http.Request, req models.DeployRequest) (map[string]string, bool) {
+	keys, err := h.deployer.CheckSSH(r.Context(), req)
+	if err != nil {
+		writeSSHError(w, err)
+		return nil, false
+	}
+
+	fingerprints := make(map[string]string)
+	unconfirmed := make(map[string]string)
+	for addr, key := range keys {
+		fingerprints[addr] = key.Fingerprint
+		if !key.Known && req.HostKeys[addr] != key.Fingerprint {
+			unconfirmed[addr] = key.Fingerprint
+		}
+	}
+	if len(unconfirmed) > 0 {
+		data, _ := json.Marshal(map[string]interface{}{
+			"error":     "the host keys of servers contacted for the first time must be confirmed",
+			"code":      "host_key_unconfirmed",
+			"host_keys": unconfirmed,
+		})
+		http.Error(w, string(data), http.StatusConflict)
+		return nil, false
+	}
+
+	if err := h.deployer.PinHostKeys(keys); err != nil {
+		writeSSHError(w, err)
+		return nil, false
+	}
+	return fingerprints, true
+}
+
+// writeSSHError replies with the error code of a failed SSH check.
+func writeSSHError(w http.ResponseWriter, err error) {
+	var sshErr *deployer.SSHError
+	if !errors.As(err, &sshErr) {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if req.SSHPass == "" {
-		http.Error(w, `{"error": "ssh_pass is required"}`, http.StatusBadRequest)
+	code := http.StatusUnprocessableEntity
+	switch sshErr.Code {
+	case deployer.SSHTimeout:
+		code = http.StatusGatewayTimeout
+	case deployer.SSHConnectionRefused, deployer.SSHUnreachable:
+		code = http.StatusBadGateway
+	case deployer.SSHHostKeyChanged:
+		code = http.StatusConflict
+	}
+	data, _ := json.Marshal(map[string]string{
+		"error": "SSH check failed for " + sshErr.Error(),
+		"code":  sshErr.Code,
+		"host":  sshErr.Host,
+	})
+	http.Error(w, string(data), code)
+}
+
+// Preflight runs the requirement and connectivity checks for a deploy request
+// without deploying, replying with a pass/warn/fail report.
+func (h *APIHandler) Preflight(w http.ResponseWriter, r *http.Request) {
+	// Limit request body to 1MB
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+
+	var req models.DeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	auditNote(r).server = req.ServerIP
+
+	if err := validateDeployRequest(&req); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.preflights <- struct{}{}:
+		defer func() { <-h.preflights }()
+	default:
+		http.Error(w, `{"error": "too many pre-flight checks are running, try again shortly"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	// Ansible only trusts pinned host keys, so first contact is confirmed here too
+	if _, ok := h.checkSSH(w, r, req); !ok {
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), preflightTimeout)
+	defer cancel()
+
+	log.Printf("Running pre-flight checks for %s", req.ServerIP)
+	report, err := h.deployer.Preflight(ctx, req)
+	if err != nil {
+		log.Printf("Pre-flight checks for %s failed: %v", req.ServerIP, err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// validateDeployRequest checks the fields shared by deployments and pre-flight
+// checks and fills in default ports.
+func validateDeployRequest(req *models.DeployRequest) error {
+	if req.Type == "" {
+		req.Type = models.DeployTypeInstall
+	}
+	if req.Type != models.DeployTypeInstall && req.Type != models.DeployTypeUpgrade {
+		return errors.New("type must be 'install' or 'upgrade'")
+	}
+	upgrade := req.Type == models.DeployTypeUpgrade
+	if upgrade && req.ChartVersion == "" {
+		return errors.New("chart_version is required for upgrades")
+	}
+	if req.ChartVersion != "" && !validChartRegex.MatchString(req.ChartVersion) {
+		return errors.New("invalid chart_version format")
+	}
+
+	// Server IP must be a valid IP address
+	if net.ParseIP(req.ServerIP) == nil {
+		return errors.New("server_ip must be a valid IP address")
+	}
+
+	if req.SSHUser == "" {
+		return errors.New("ssh_user is required")
+	}
+	if req.SSHPass == "" && req.SSHKey == "" {
+		return errors.New("ssh_pass or ssh_key is required")
+	}
+	if req.SSHKey != "" {
+		if _, err := deployer.ParsePrivateKey(req.SSHKey, req.SSHKeyPassphrase); err != nil {
+			return errors.New("ssh_key must be a valid private key (check the passphrase if it is encrypted)")
+		}
+	}
+
+	// Jump host: optional, but fully validated since it is embedded in ssh arguments
+	if req.JumpHost != "" {
+		if net.ParseIP(req.JumpHost) == nil && !validDomainRegex.MatchString(req.JumpHost) {
+			return errors.New("jump_host must be a valid IP address or hostname")
+		}
+		if !validUserRegex.MatchString(req.JumpUser) {
+			return errors.New("jump_user is required when jump_host is set and may only contain letters, digits, '.', '_' and '-'")
+		}
+		if req.JumpPort < 0 || req.JumpPort > 65535 {
+			return errors.New("jump_port must be between 1 and 65535")
+		}
+		if req.JumpPort == 0 {
+			req.JumpPort = 22
+		}
+		if req.JumpKey != "" {
+			if _, err := deployer.ParsePrivateKey(req.JumpKey, req.JumpKeyPassphrase); err != nil {
+				return errors.New("jump_key must be a valid private key (check the passphrase if it is encrypted)")
+			}
+		}
+	}
+
+	// Cluster nodes: optional; hosts are written to the inventory, so validate strictly
+	if upgrade && len(req.Nodes) > 0 {
+		return errors.New("nodes cannot be added during an upgrade")
+	}
+	if len(req.Nodes) > maxClusterNodes {
+		return fmt.Errorf("at most %d additional nodes are supported", maxClusterNodes)
+	}
+	seenHosts := map[string]bool{req.ServerIP: true}
+	for _, node := range req.Nodes {
+		if net.ParseIP(node.Host) == nil && !validDomainRegex.MatchString(node.Host) {
+			return errors.New("each node host must be a valid IP address or hostname")
+		}
+		if node.Role != models.NodeRoleServer && node.Role != models.NodeRoleAgent {
+			return errors.New("node role must be 'server' or 'agent'")
+		}
+		if seenHosts[node.Host] {
+			return errors.New("each node may only be listed once and must differ from server_ip")
+		}
+		seenHosts[node.Host] = true
+	}
+
 	// Domain format validation
 	if req.Domain == "" || !validDomainRegex.MatchString(req.Domain) {
-		http.Error(w, `{"error": "domain must be a valid domain name"}`, http.StatusBadRequest)
-		return
+		return errors.New("domain must be a valid domain name")
+	}
+
+	// Upgrades only redeploy the chart; SSL and CloudStack stay as installed
+	if upgrade {
+		req.SSLMode, req.SSLCert, req.SSLKey, req.LetsEncryptEmail = "", "", "", ""
+		req.CloudStackMode, req.CloudStackVersion = "", ""
+		if req.SSHPort == 0 {
+			req.SSHPort = 22
+		}
+		return nil
 	}
 
 	if req.SSLMode != "letsencrypt" && req.SSLMode != "custom" {
-		http.Error(w, `{"error": "ssl_mode must be 'letsencrypt' or 'custom'"}`, http.StatusBadRequest)
-		return
+		return errors.New("ssl_mode must be 'letsencrypt' or 'custom'")
 	}
 	if req.SSLMode == "letsencrypt" && req.LetsEncryptEmail == "" {
-		http.Error(w, `{"error": "letsencrypt_email is required when ssl_mode is 'letsencrypt'"}`, http.StatusBadRequest)
-		return
+		return errors.New("letsencrypt_email is required when ssl_mode is 'letsencrypt'")
 	}
 	if req.SSLMode == "letsencrypt" && !strings.Contains(req.LetsEncryptEmail, "@") {
-		http.Error(w, `{"error": "invalid email format"}`, http.StatusBadRequest)
-		return
+		return errors.New("invalid email format")
 	}
 	if req.SSLMode == "custom" {
 		if req.SSLCert == "" || req.SSLKey == "" {
-			http.Error(w, `{"error": "ssl_cert and ssl_key are required when ssl_mode is 'custom'"}`, http.StatusBadRequest)
-			return
+			return errors.New("ssl_cert and ssl_key are required when ssl_mode is 'custom'")
 		}
 		if !strings.Contains(req.SSLCert, "BEGIN CERTIFICATE") {
-			http.Error(w, `{"error": "ssl_cert must be a valid PEM certificate (missing BEGIN CERTIFICATE)"}`, http.StatusBadRequest)
-			return
+			return errors.New("ssl_cert must be a valid PEM certificate (missing BEGIN CERTIFICATE)")
 		}
 		if !strings.Contains(req.SSLKey, "BEGIN") || !strings.Contains(req.SSLKey, "PRIVATE KEY") {
-			http.Error(w, `{"error": "ssl_key must be a valid PEM private key (missing BEGIN PRIVATE KEY)"}`, http.StatusBadRequest)
-			return
+			return errors.New("ssl_key must be a valid PEM private key (missing BEGIN PRIVATE KEY)")
 		}
 	}
 
 	if req.CloudStackMode != "existing" && req.CloudStackMode != "simulator" {
-		http.Error(w, `{"error": "cloudstack_mode must be 'existing' or 'simulator'"}`, http.StatusBadRequest)
-		return
+		return errors.New("cloudstack_mode must be 'existing' or 'simulator'")
 	}
 	if req.CloudStackMode == "simulator" && req.CloudStackVersion != "" {
 		if !validVersionRegex.MatchString(req.CloudStackVersion) {
-			http.Error(w, `{"error": "invalid cloudstack version format"}`, http.StatusBadRequest)
-			return
+			return errors.New("invalid cloudstack version format")
 		}
 	}
 
-	if req.ECRToken == "" {
-		http.Error(w, `{"error": "ecr_token is required"}`, http.StatusBadRequest)
+	if req.SSHPort == 0 {
+		req.SSHPort = 22
+	}
+	return nil
+}
+
+// jsonError writes an error response with a JSON-escaped message.
+func jsonError(w http.ResponseWriter, msg string, code int) {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	http.Error(w, string(data), code)
+}
+
+// ResumeDeployment starts a new run that reuses a finished deployment's request
+// and executes only the roles from the failed stage onward.
+func (h *APIHandler) ResumeDeployment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !validIDRegex.MatchString(id) {
+		http.Error(w, `{"error": "invalid deployment ID"}`, http.StatusBadRequest)
 		return
 	}
 
-	if req.SSHPort == 0 {
-		req.SSHPort = 22
+	h.mu.RLock()
+	parent, ok := h.deployments[id]
+	if !ok {
+		h.mu.RUnlock()
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAct(identity(r), parent) {
+		h.mu.RUnlock()
+		notFoundForeign(w, r)
+		return
+	}
+	status := parent.Status
+	owner, viewers := parent.Owner, parent.Viewers
+	req := parent.Request
+	resumeIdx := parent.ResumeIndex()
+	stageList := make([]models.Stage, len(parent.Stages))
+	copy(stageList, parent.Stages)
+	h.mu.RUnlock()
+
+	if status != models.StatusFailed && status != models.StatusCancelled && status != models.StatusInterrupted {
+		http.Error(w, `{"error": "only failed, cancelled or interrupted deployments can be resumed"}`, http.StatusConflict)
+		return
+	}
+	// The request (with secrets) is only held in memory, so it is lost on restart
+	if req.ServerIP == "" {
+		http.Error(w, `{"error": "deployment settings are no longer available; start a new deployment"}`, http.StatusConflict)
+		return
+	}
+
+	// Stages before the resume point are already complete; the rest run again
+	var roles []string
+	for i := range stageList {
+		if i < resumeIdx {
+			stageList[i].Status = "done"
+			continue
+		}
+		stageList[i].Status = "pending"
+		if stageList[i].Role != "" {
+			roles = append(roles, stageList[i].Role)
+		}
+	}
+	if len(roles) == 0 {
+		http.Error(w, `{"error": "no stages left to resume"}`, http.StatusConflict)
+		return
+	}
+	req.Roles = roles
+
+	hostKeys, ok := h.checkSSH(w, r, req)
+	if !ok {
+		return
+	}
+
+	dep := &models.Deployment{
+		ID:           generateID(),
+		ParentID:     id,
+		ResumedFrom:  stageList[resumeIdx].Name,
+		Request:      req,
+		Summary:      models.NewSummary(req),
+		Status:       models.StatusPending,
+		CreatedBy:    identity(r).Name,
+		Owner:        owner,
+		Viewers:      viewers,
+		StartedAt:    time.Now(),
+		Stages:       stageList,
+		CurrentStage: -1,
+		Nodes:        models.BuildNodes(req),
 	}
+	dep.Summary.HostKeys = hostKeys
+
+	note := auditNote(r)
+	note.deploymentID, note.detail = dep.ID, "resumed from "+id
+	h.startDeployment(w, dep)
+}
 
-	// --- Rate limiting: max 1 deploy per 10 seconds ---
-	h.serverMu.Lock()
-	if time.Since(h.lastDeploy) < 10*time.Second {
-		h.serverMu.Unlock()
-		http.Error(w, `{"error": "please wait before starting another deployment"}`, http.StatusTooManyRequests)
+// UninstallDeployment starts a run of the uninstall playbook against a
+// finished deployment's server, reusing its connection settings. The body
+// optionally selects what to remove besides the Helm release; by default
+// PVCs, the namespace, the host databases and the simulator are kept.
+func (h *APIHandler) UninstallDeployment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !validIDRegex.MatchString(id) {
+		http.Error(w, `{"error": "invalid deployment ID"}`, http.StatusBadRequest)
 		return
 	}
 
-	// --- Concurrent deployment guard: one deploy per server ---
-	if h.activeServers[req.ServerIP] {
-		h.serverMu.Unlock()
-		http.Error(w, `{"error": "a deployment is already running on this server"}`, http.StatusConflict)
+	var opts models.UninstallOptions
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.mu.RLock()
+	parent, ok := h.deployments[id]
+	if !ok {
+		h.mu.RUnlock()
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAct(identity(r), parent) {
+		h.mu.RUnlock()
+		notFoundForeign(w, r)
+		return
+	}
+	status := parent.Status
+	owner, viewers := parent.Owner, parent.Viewers
+	req := parent.Request
+	h.mu.RUnlock()
+
+	if !status.IsFinished() {
+		http.Error(w, `{"error": "deployment is still in progress"}`, http.StatusConflict)
+		return
+	}
+	// The request (with secrets) is only held in memory, so it is lost on restart
+	if req.ServerIP == "" {
+		http.Error(w, `{"error": "deployment settings are no longer available"}`, http.StatusConflict)
+		return
+	}
+
+	// Only the target server is touched; cluster nodes stay joined
+	req.Type = models.DeployTypeUninstall
+	req.Uninstall = opts
+	req.ChartVersion = ""
+	req.Nodes = nil
+	req.Roles = nil
+
+	hostKeys, ok := h.checkSSH(w, r, req)
+	if !ok {
 		return
 	}
-	h.activeServers[req.ServerIP] = true
-	h.lastDeploy = time.Now()
-	h.serverMu.Unlock()
 
-	id := generateID()
-	stages := models.BuildStages(req)
 	dep := &models.Deployment{
-		ID:           id,
+		ID:           generateID(),
+		ParentID:     id,
 		Request:      req,
 		Summary:      models.NewSummary(req),
 		Status:       models.StatusPending,
+		CreatedBy:    identity(r).Name,
+		Owner:        owner,
+		Viewers:      viewers,
 		StartedAt:    time.Now(),
-		Logs:         []string{},
-		Stages:       stages,
+		Stages:       h.stages.Build(req),
 		CurrentStage: -1,
+		Nodes:        models.BuildNodes(req),
 	}
+	dep.Summary.HostKeys = hostKeys
+
+	note := auditNote(r)
+	note.deploymentID, note.detail = dep.ID, "uninstall of "+id
+	h.startDeployment(w, dep)
+}
+
+// startDeployment registers the deployment and queues it behind any other
+// deployment sharing one of its hosts, replying 202 with the new deployment ID.
+func (h *APIHandler) startDeployment(w http.ResponseWriter, dep *models.Deployment) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dep.Status = models.StatusQueued
 
 	h.mu.Lock()
-	h.deployments[id] = dep
+	h.deployments[dep.ID] = dep
+	h.cancels[dep.ID] = cancel
 	h.mu.Unlock()
 
-	h.saveStateNow() // Persist immediately so state survives a crash
+	err := h.queue.Enqueue(&queue.Job{
+		ID:   dep.ID,
+		Keys: dep.Request.Hosts(), // Never two deployments touching the same node at once
+		Run:  func() { h.runDeployment(ctx, dep) },
+	})
+	if err != nil {
+		cancel()
+		h.mu.Lock()
+		delete(h.deployments, dep.ID)
+		delete(h.cancels, dep.ID)
+		h.mu.Unlock()
+		http.Error(w, `{"error": "too many deployments are queued, try again later"}`, http.StatusServiceUnavailable)
+		return
+	}
 
-	go h.runDeployment(dep)
+	h.saveStateNow(dep.ID) // Persist immediately so state survives a crash
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"id":     id,
-		"status": "pending",
-		"stages": stages,
+		"id":             dep.ID,
+		"status":         models.StatusQueued,
+		"queue_position": h.queue.Position(dep.ID),
+		"stages":         dep.Stages,
+		"parent_id":      dep.ParentID,
 	})
 }
 
-func (h *APIHandler) runDeployment(dep *models.Deployment) {
-	// Release the server lock when deployment finishes
+// runDeployment executes a deployment on a queue worker.
+func (h *APIHandler) runDeployment(ctx context.Context, dep *models.Deployment) {
+	// Release the cancel func when deployment finishes
 	defer func() {
-		h.serverMu.Lock()
-		delete(h.activeServers, dep.Request.ServerIP)
-		h.serverMu.Unlock()
+		h.mu.Lock()
+		if cancel, ok := h.cancels[dep.ID]; ok {
+			cancel()
+			delete(h.cancels, dep.ID)
+		}
+		h.mu.Unlock()
 	}()
 
 	h.mu.Lock()
 	dep.Status = models.StatusRunning
+	h.dirty[dep.ID] = true
 	h.mu.Unlock()
-	h.markDirty()
+	h.notify(dep.ID)
 
-	err := h.deployer.Deploy(dep.Request, func(line string) {
+	creds, err := h.deployer.Deploy(ctx, dep.Request, func(line string) {
 		h.mu.Lock()
-		dep.Logs = append(dep.Logs, line)
+		h.appendLog(dep, line)
 		h.mu.Unlock()
 
-		// Broadcast log line via SSE
-		h.broadcast(dep.ID, SSEEvent{Type: "log", Data: line})
-
-		// Detect stage transitions from log_step output
-		h.detectStage(dep, line)
+		// Wake SSE clients to read the new line
+		h.notify(dep.ID)
 
 		log.Printf("[%s] %s", dep.ID, line)
+	}, func(event deployer.Event) {
+		// Drive stage transitions from structured callback events
+		h.handleEvent(dep, event)
 	})
 
+	if creds != nil {
+		if saveErr := h.creds.Save(dep.ID, creds); saveErr != nil {
+			log.Printf("[%s] Failed to store credentials: %v", dep.ID, saveErr)
+		} else {
+			h.mu.Lock()
+			dep.HasCredentials = true
+			h.mu.Unlock()
+		}
+	}
+
 	h.mu.Lock()
 	now := time.Now()
 	dep.EndedAt = &now
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
+		dep.Status = models.StatusCancelled
+		h.appendLog(dep, "Deployment cancelled by user")
+		// Mark current running stage as cancelled
+		if dep.CurrentStage >= 0 && dep.CurrentStage < len(dep.Stages) {
+			dep.Stages[dep.CurrentStage].Status = "cancelled"
+		}
+		markRunningNodes(dep, "cancelled")
+	} else if err != nil {
 		dep.Status = models.StatusFailed
-		errMsg := "ERROR: " + err.Error()
-		dep.Logs = append(dep.Logs, errMsg)
+		h.appendLog(dep, "ERROR: "+err.Error())
 		// Mark current running stage as error
 		if dep.CurrentStage >= 0 && dep.CurrentStage < len(dep.Stages) {
 			dep.Stages[dep.CurrentStage].Status = "error"
 		}
-		h.mu.Unlock()
-		h.broadcast(dep.ID, SSEEvent{Type: "log", Data: errMsg})
+		markRunningNodes(dep, "error")
 	} else {
 		dep.Status = models.StatusSuccess
 		// Mark all remaining stages as done
@@ -372,22 +1257,76 @@ func (h *APIHandler) runDeployment(dep *models.Deployment) {
 				dep.Stages[i].Status = "done"
 			}
 		}
-		h.mu.Unlock()
+		for i := range dep.Nodes {
+			dep.Nodes[i].Status = "done"
+		}
 	}
+	wiped := dep.Status == models.StatusSuccess && dep.Request.Type == models.DeployTypeUninstall && dep.Request.Uninstall.DeleteDatabases
+	h.mu.Unlock()
 
-	// Save deployment log to local file
-	h.saveDeploymentLog(dep)
+	if wiped {
+		h.deleteCredentials(dep)
+	}
+	h.finishDeployment(dep)
+}
 
-	// Persist final state immediately
-	h.saveStateNow()
+// deleteCredentials removes the stored credentials of every deployment on the
+// server an uninstall wiped, since the databases they open no longer exist.
+func (h *APIHandler) deleteCredentials(uninstall *models.Deployment) {
+	server := uninstall.Request.ServerIP
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	deleted := 0
+	for _, d := range h.deployments {
+		if !d.HasCredentials || d.Summary.ServerIP != server {
+			continue
+		}
+		if err := h.creds.Delete(d.ID); err != nil {
+			log.Printf("[%s] %v", d.ID, err)
+			h.appendLog(uninstall, "WARNING: could not delete the saved credentials of deployment "+d.ID)
+			continue
+		}
+		d.HasCredentials = false
+		h.dirty[d.ID] = true
+		deleted++
+	}
+	if deleted > 0 {
+		h.appendLog(uninstall, fmt.Sprintf("Deleted the saved credentials of %d deployment(s) on %s", deleted, server))
+	}
+}
 
-	doneData, _ := json.Marshal(map[string]interface{}{
-		"status": dep.Status,
-		"stages": dep.Stages,
-	})
-	h.broadcast(dep.ID, SSEEvent{Type: "done", Data: string(doneData)})
+// markRunningNodes gives nodes still in progress the final status of a
+// deployment that stopped early. Caller must hold h.mu.
+func markRunningNodes(dep *models.Deployment, status string) {
+	for i := range dep.Nodes {
+		if dep.Nodes[i].Status == "running" {
+			dep.Nodes[i].Status = status
+		}
+	}
+}
+
+// finishDeployment persists a deployment that reached a terminal status and
+// releases its log file and SSE subscribers.
+func (h *APIHandler) finishDeployment(dep *models.Deployment) {
+	h.mu.RLock()
+	entry := audit.Entry{Actor: dep.CreatedBy, Action: "deployment_finished", DeploymentID: dep.ID,
+		Server: dep.Summary.ServerIP, Outcome: audit.OutcomeFailed, Detail: string(dep.Status)}
+	if dep.Status == models.StatusSuccess {
+		entry.Outcome = audit.OutcomeSuccess
+	}
+	h.mu.RUnlock()
+	h.record(entry)
+
+	// Release the log file and in-memory tail; later reads go to disk
+	h.logs.Finish(dep.ID)
+	h.mu.Lock()
+	delete(h.recentLogs, dep.ID)
+	h.mu.Unlock()
 
-	// Close all subscriber channels
+	// Persist final state immediately
+	h.saveStateNow(dep.ID)
+
+	// Close all subscriber channels; clients flush the remaining events and send done
 	h.subMu.Lock()
 	if subs, ok := h.subscribers[dep.ID]; ok {
 		for _, ch := range subs {
@@ -398,60 +1337,225 @@ func (h *APIHandler) runDeployment(dep *models.Deployment) {
 	h.subMu.Unlock()
 }
 
-// detectStage checks if a log line matches a known stage name and updates stage status.
-func (h *APIHandler) detectStage(dep *models.Deployment, line string) {
+// CancelDeployment stops a queued or running deployment. Queued deployments
+// are dropped from the queue immediately; for running ones the deployment
+// goroutine records the cancelled status.
+func (h *APIHandler) CancelDeployment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !validIDRegex.MatchString(id) {
+		http.Error(w, `{"error": "invalid deployment ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.mu.RLock()
+	dep, ok := h.deployments[id]
+	cancel, running := h.cancels[id]
+	h.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAct(identity(r), dep) {
+		notFoundForeign(w, r)
+		return
+	}
+	if !running {
+		http.Error(w, `{"error": "deployment is not running"}`, http.StatusConflict)
+		return
+	}
+
+	log.Printf("[%s] Cancellation requested", id)
+
+	// A queued deployment never reaches a worker, so finish it here
+	removed := h.queue.Remove(id)
+	cancel()
+	if removed {
+		h.mu.Lock()
+		now := time.Now()
+		dep.EndedAt = &now
+		dep.Status = models.StatusCancelled
+		h.appendLog(dep, "Deployment cancelled before it started")
+		delete(h.cancels, id)
+		h.mu.Unlock()
+		h.finishDeployment(dep)
+	}
+
+	status := "cancelling"
+	if removed {
+		status = string(models.StatusCancelled)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     id,
+		"status": status,
+	})
+}
+
+// ShareDeployment replaces the list of subjects, besides the owner, that may
+// see a deployment. Sharing grants viewing only, never resume, cancel or uninstall.
+func (h *APIHandler) ShareDeployment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !validIDRegex.MatchString(id) {
+		http.Error(w, `{"error": "invalid deployment ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Viewers []string `json:"viewers"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<14)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Viewers) > maxViewers {
+		jsonError(w, fmt.Sprintf("a deployment can be shared with at most %d subjects", maxViewers), http.StatusBadRequest)
+		return
+	}
+	viewers := make([]string, 0, len(req.Viewers))
+	seen := make(map[string]bool)
+	for _, v := range req.Viewers {
+		if !validSubject.MatchString(v) {
+			jsonError(w, fmt.Sprintf("invalid viewer %q; use the subject shown by /api/session", v), http.StatusBadRequest)
+			return
+		}
+		if !seen[v] {
+			seen[v] = true
+			viewers = append(viewers, v)
+		}
+	}
+
+	h.mu.Lock()
+	dep, ok := h.deployments[id]
+	if !ok {
+		h.mu.Unlock()
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAct(identity(r), dep) {
+		h.mu.Unlock()
+		notFoundForeign(w, r)
+		return
+	}
+	dep.Viewers = viewers
+	h.dirty[id] = true
+	h.mu.Unlock()
+
+	log.Printf("[%s] Shared with %d viewer(s) by %s", id, len(viewers), identity(r).Name)
+	auditNote(r).detail = "viewers: " + strings.Join(viewers, ", ")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      id,
+		"viewers": viewers,
+	})
+}
+
+// handleEvent applies a structured callback event to the deployment's stage progress.
+func (h *APIHandler) handleEvent(dep *models.Deployment, event deployer.Event) {
+	switch event.Type {
+	case deployer.EventRoleStart:
+		h.setStageStatus(dep, event.Role, "running")
+	case deployer.EventRoleEnd:
+		h.setStageStatus(dep, event.Role, "done")
+	case deployer.EventTaskOK, deployer.EventTaskChanged:
+		h.setNodeStatus(dep, event.Host, event.Role, "running")
+	case deployer.EventTaskFailed:
+		if !event.IgnoreErrors {
+			h.setNodeStatus(dep, event.Host, event.Role, "error")
+		}
+	case deployer.EventUnreachable:
+		h.setNodeStatus(dep, event.Host, event.Role, "error")
+	case deployer.EventStats:
+		status := "done"
+		if event.Failures > 0 || event.Unreachable > 0 {
+			status = "error"
+		}
+		h.setNodeStatus(dep, event.Host, "", status)
+	}
+}
+
+// setNodeStatus records the stage a cluster node is working on. role may be
+// empty for events outside any stage. Failed nodes keep their error status.
+func (h *APIHandler) setNodeStatus(dep *models.Deployment, host, role, status string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	for i, stage := range dep.Stages {
-		if stage.Status != "pending" {
+	for i := range dep.Nodes {
+		node := &dep.Nodes[i]
+		if node.Host != host {
 			continue
 		}
-		// Match against MatchKey if set, otherwise fall back to Name
-		matchKey := stage.MatchKey
-		if matchKey == "" {
-			matchKey = stage.Name
+		if node.Status == "error" && status != "error" {
+			return
 		}
-		if strings.Contains(line, matchKey) {
-			// Mark ALL stages before the current one as done (handles skipped stages)
-			for j := 0; j < i; j++ {
-				if dep.Stages[j].Status == "running" || dep.Stages[j].Status == "pending" {
-					dep.Stages[j].Status = "done"
-				}
+		stageName := node.Stage
+		for _, stage := range dep.Stages {
+			if role != "" && stage.Role == role {
+				stageName = stage.Name
+				break
 			}
-			dep.Stages[i].Status = "running"
-			dep.CurrentStage = i
+		}
+		if node.Stage == stageName && node.Status == status {
+			return
+		}
+		node.Stage = stageName
+		node.Status = status
+		h.dirty[dep.ID] = true
+		h.notify(dep.ID)
+		return
+	}
+}
+
+// setStageStatus updates the stage implemented by role and broadcasts the transition.
+func (h *APIHandler) setStageStatus(dep *models.Deployment, role, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-			// Mark state dirty on every stage transition
-			h.stateDirty = true
+	idx := -1
+	for i, stage := range dep.Stages {
+		if stage.Role == role && (stage.Status == "pending" || stage.Status == "running") {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return
+	}
 
-			doneCount := 0
-			for _, s := range dep.Stages {
-				if s.Status == "done" {
-					doneCount++
-				}
+	if status == "running" {
+		// Mark ALL stages before the current one as done (handles skipped stages)
+		for j := 0; j < idx; j++ {
+			if dep.Stages[j].Status == "running" || dep.Stages[j].Status == "pending" {
+				dep.Stages[j].Status = "done"
 			}
-
-			stageData, _ := json.Marshal(map[string]interface{}{
-				"index":      i,
-				"name":       stage.Name,
-				"status":     "running",
-				"done_count": doneCount,
-				"total":      len(dep.Stages),
-			})
-			h.broadcast(dep.ID, SSEEvent{Type: "stage", Data: string(stageData)})
-			break
 		}
+		dep.CurrentStage = idx
 	}
+	dep.Stages[idx].Status = status
+
+	// Mark state dirty on every stage transition
+	h.dirty[dep.ID] = true
+
+	h.notify(dep.ID)
 }
 
 // ==========================================
 // SSE STREAMING
 // ==========================================
 
-// subscribe creates a channel for an SSE client to receive events.
-func (h *APIHandler) subscribe(deployID string) chan SSEEvent {
-	ch := make(chan SSEEvent, 64)
+// subscribe creates a wake-up channel for an SSE client. The channel holds at
+// most one pending signal; clients read the actual events from the deployment
+// state and log store, so a slow client never loses anything.
+func (h *APIHandler) subscribe(deployID string) chan struct{} {
+	ch := make(chan struct{}, 1)
 	h.subMu.Lock()
 	h.subscribers[deployID] = append(h.subscribers[deployID], ch)
 	h.subMu.Unlock()
@@ -459,7 +1563,7 @@ func (h *APIHandler) subscribe(deployID string) chan SSEEvent {
 }
 
 // unsubscribe removes a channel from the subscriber list.
-func (h *APIHandler) unsubscribe(deployID string, ch chan SSEEvent) {
+func (h *APIHandler) unsubscribe(deployID string, ch chan struct{}) {
 	h.subMu.Lock()
 	defer h.subMu.Unlock()
 	subs := h.subscribers[deployID]
@@ -471,23 +1575,143 @@ func (h *APIHandler) unsubscribe(deployID string, ch chan SSEEvent) {
 	}
 }
 
-// broadcast sends an SSE event to all subscribers for a deployment.
-func (h *APIHandler) broadcast(deployID string, event SSEEvent) {
+// notifyQueued wakes SSE clients of every queued deployment so they see
+// their new queue position.
+func (h *APIHandler) notifyQueued() {
+	h.mu.RLock()
+	var ids []string
+	for id, dep := range h.deployments {
+		if dep.Status == models.StatusQueued {
+			ids = append(ids, id)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, id := range ids {
+		h.notify(id)
+	}
+}
+
+// notify wakes every SSE client of a deployment.
+func (h *APIHandler) notify(deployID string) {
 	h.subMu.Lock()
-	subs := make([]chan SSEEvent, len(h.subscribers[deployID]))
-	copy(subs, h.subscribers[deployID])
-	h.subMu.Unlock()
+	defer h.subMu.Unlock()
 
-	for _, ch := range subs {
+	for _, ch := range h.subscribers[deployID] {
 		select {
-		case ch <- event:
+		case ch <- struct{}{}:
 		default:
-			// Drop event if channel is full
+			// A wake-up is already pending
+		}
+	}
+}
+
+// sseClient tracks what one SSE connection has been sent. The event id is the
+// number of log lines delivered so far, which is where a reconnect resumes.
+type sseClient struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	cursor   int      // Next log line to send
+	stages   []string // Stage statuses last sent
+	nodes    string   // Node list last sent (JSON)
+	status   models.DeploymentStatus
+	queuePos int
+}
+
+func (c *sseClient) send(event, data string) error {
+	_, err := fmt.Fprintf(c.w, "id: %d\nevent: %s\ndata: %s\n\n", c.cursor, event, data)
+	return err
+}
+
+// syncSSE sends log lines, stage transitions and node progress the client has
+// not seen yet.
+// It reports whether the deployment has finished.
+func (h *APIHandler) syncSSE(dep *models.Deployment, c *sseClient) (bool, error) {
+	h.mu.RLock()
+	logCount := dep.LogCount
+	stageList := append([]models.Stage(nil), dep.Stages...)
+	var nodesJSON []byte
+	if len(dep.Nodes) > 0 {
+		nodesJSON, _ = json.Marshal(dep.Nodes)
+	}
+	status := dep.Status
+	h.mu.RUnlock()
+
+	queuePos := 0
+	if status == models.StatusQueued {
+		queuePos = h.queue.Position(dep.ID)
+	}
+	if !status.IsFinished() && (status != c.status || queuePos != c.queuePos) {
+		statusData, _ := json.Marshal(map[string]interface{}{
+			"status":         status,
+			"queue_position": queuePos,
+		})
+		if err := c.send("status", string(statusData)); err != nil {
+			return false, err
 		}
+		c.status, c.queuePos = status, queuePos
 	}
+
+	err := h.eachLog(dep.ID, c.cursor, logCount, func(line string) error {
+		c.cursor++
+		return c.send("log", line)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	doneCount := 0
+	for _, stage := range stageList {
+		if stage.Status == "done" {
+			doneCount++
+		}
+	}
+	for i, stage := range stageList {
+		// The done event carries the final stage list
+		if status.IsFinished() {
+			break
+		}
+		if i < len(c.stages) && c.stages[i] == stage.Status {
+			continue
+		}
+		stageData, _ := json.Marshal(map[string]interface{}{
+			"index":      i,
+			"name":       stage.Name,
+			"status":     stage.Status,
+			"done_count": doneCount,
+			"total":      len(stageList),
+		})
+		if err := c.send("stage", string(stageData)); err != nil {
+			return false, err
+		}
+	}
+	c.stages = c.stages[:0]
+	for _, stage := range stageList {
+		c.stages = append(c.stages, stage.Status)
+	}
+
+	if nodesJSON != nil && string(nodesJSON) != c.nodes {
+		if err := c.send("nodes", string(nodesJSON)); err != nil {
+			return false, err
+		}
+		c.nodes = string(nodesJSON)
+	}
+
+	if status.IsFinished() {
+		doneData, _ := json.Marshal(map[string]interface{}{
+			"status": status,
+			"stages": stageList,
+		})
+		if err := c.send("done", string(doneData)); err != nil {
+			return false, err
+		}
+	}
+	c.flusher.Flush()
+	return status.IsFinished(), nil
 }
 
 // StreamSSE handles the SSE endpoint for real-time deployment streaming.
+// Clients resume from the Last-Event-ID header or the since query parameter.
 func (h *APIHandler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -497,6 +1721,20 @@ func (h *APIHandler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	cursor := 0
+	if since != "" {
+		n, err := strconv.Atoi(since)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error": "invalid event ID"}`, http.StatusBadRequest)
+			return
+		}
+		cursor = n
+	}
+
 	h.mu.RLock()
 	dep, ok := h.deployments[id]
 	h.mu.RUnlock()
@@ -505,6 +1743,10 @@ func (h *APIHandler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
 		return
 	}
+	if !canView(identity(r), dep) {
+		notFoundForeign(w, r)
+		return
+	}
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -516,64 +1758,47 @@ func (h *APIHandler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	// Subscribe FIRST to avoid missing events during catch-up
+	// Subscribe FIRST so no change between catch-up and waiting goes unnoticed
 	ch := h.subscribe(id)
 	defer h.unsubscribe(id, ch)
 
-	// Send catch-up: existing stages
+	client := &sseClient{w: w, flusher: flusher}
+
+	// Send catch-up: full stage list, then logs from the resume point
 	h.mu.RLock()
 	stagesJSON, _ := json.Marshal(dep.Stages)
-	existingLogs := make([]string, len(dep.Logs))
-	copy(existingLogs, dep.Logs)
-	currentStatus := dep.Status
-	h.mu.RUnlock()
-
-	fmt.Fprintf(w, "event: stages\ndata: %s\n\n", stagesJSON)
-	flusher.Flush()
-
-	// Send catch-up: existing logs
-	for _, line := range existingLogs {
-		fmt.Fprintf(w, "event: log\ndata: %s\n\n", line)
+	if cursor > dep.LogCount {
+		cursor = dep.LogCount
 	}
-	flusher.Flush()
-
-	// If already finished (success, failed, or interrupted), send done event and return
-	if currentStatus == models.StatusSuccess || currentStatus == models.StatusFailed || currentStatus == models.StatusInterrupted {
-		h.mu.RLock()
-		doneData, _ := json.Marshal(map[string]interface{}{
-			"status": dep.Status,
-			"stages": dep.Stages,
-		})
-		h.mu.RUnlock()
-		fmt.Fprintf(w, "event: done\ndata: %s\n\n", doneData)
-		flusher.Flush()
-		return
+	for _, stage := range dep.Stages {
+		client.stages = append(client.stages, stage.Status)
 	}
+	h.mu.RUnlock()
 
-	// Drain any events that arrived during catch-up to avoid duplicates
-	draining := true
-	for draining {
-		select {
-		case _, ok := <-ch:
-			if !ok {
-				return
-			}
-		default:
-			draining = false
-		}
+	client.cursor = cursor
+	if err := client.send("stages", string(stagesJSON)); err != nil {
+		return
 	}
 
 	ctx := r.Context()
 	for {
+		finished, err := h.syncSSE(dep, client)
+		if err != nil {
+			log.Printf("[%s] SSE stream ended: %v", id, err)
+			return
+		}
+		if finished {
+			return
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		case event, ok := <-ch:
+		case _, ok := <-ch:
 			if !ok {
-				return
+				// Deployment finished; the next sync sends the rest and done
+				ch = nil
 			}
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
-			flusher.Flush()
 		}
 	}
 }
@@ -586,10 +1811,17 @@ func (h *APIHandler) ListDeployments(w http.ResponseWriter, r *http.Request) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	caller := identity(r)
 	deps := make([]*models.Deployment, 0, len(h.deployments))
 	for _, d := range h.deployments {
+		if !canView(caller, d) {
+			continue
+		}
 		summary := *d
 		summary.Logs = nil
+		if d.Status == models.StatusQueued {
+			summary.QueuePosition = h.queue.Position(d.ID)
+		}
 		deps = append(deps, &summary)
 	}
 
@@ -597,6 +1829,10 @@ func (h *APIHandler) ListDeployments(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(deps)
 }
 
+// GetDeployment returns a deployment with one page of its log: at most
+// recentLogLines lines from the since query parameter, or the last lines
+// without it. Clients follow log_start and log_count to read on; the whole
+// log is served by DownloadLog.
 func (h *APIHandler) GetDeployment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -606,6 +1842,16 @@ func (h *APIHandler) GetDeployment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	since := -1
+	if s := r.URL.Query().Get("since"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error": "invalid since parameter"}`, http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
 	h.mu.RLock()
 	dep, ok := h.deployments[id]
 	h.mu.RUnlock()
@@ -614,27 +1860,39 @@ func (h *APIHandler) GetDeployment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(dep)
-}
-
-// saveDeploymentLog writes all deployment logs to a local file.
-func (h *APIHandler) saveDeploymentLog(dep *models.Deployment) {
-	os.MkdirAll("logs", 0750)
+	if !canView(identity(r), dep) {
+		notFoundForeign(w, r)
+		return
+	}
 
 	h.mu.RLock()
-	logs := make([]string, len(dep.Logs))
-	copy(logs, dep.Logs)
+	resp := *dep
+	resp.Stages = append([]models.Stage(nil), dep.Stages...)
 	h.mu.RUnlock()
 
-	logFile := filepath.Join("logs", fmt.Sprintf("stackbill-deploy-%s.log", dep.ID))
-	content := strings.Join(logs, "\n") + "\n"
-	if err := os.WriteFile(logFile, []byte(content), 0600); err != nil {
-		log.Printf("Failed to save deployment log: %v", err)
-	} else {
-		log.Printf("Deployment log saved to %s", logFile)
+	if resp.Status == models.StatusQueued {
+		resp.QueuePosition = h.queue.Position(id)
+	}
+
+	from := since
+	if from < 0 {
+		from = max(resp.LogCount-recentLogLines, 0)
+	}
+	from = min(from, resp.LogCount)
+	resp.LogStart = from
+	resp.Logs = []string{}
+	err := h.eachLog(id, from, min(from+recentLogLines, resp.LogCount), func(line string) error {
+		resp.Logs = append(resp.Logs, line)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to read logs: %v", id, err)
+		http.Error(w, `{"error": "failed to read deployment logs"}`, http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // DownloadLog serves the deployment log file as a download.
@@ -648,15 +1906,370 @@ func (h *APIHandler) DownloadLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logFile := filepath.Join("logs", fmt.Sprintf("stackbill-deploy-%s.log", id))
-	if _, err := os.Stat(logFile); os.IsNotExist(err) {
+	h.mu.RLock()
+	dep, ok := h.deployments[id]
+	h.mu.RUnlock()
+	if !ok {
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canView(identity(r), dep) {
+		notFoundForeign(w, r)
+		return
+	}
+
+	count, err := h.logs.Count(id)
+	if err != nil || count == 0 {
 		http.Error(w, `{"error": "log file not found"}`, http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stackbill-deploy-%s.log"`, id))
-	http.ServeFile(w, r, logFile)
+	err = h.logs.Read(id, 0, func(_ int, line string) error {
+		_, err := io.WriteString(w, line+"\n")
+		return err
+	})
+	if err != nil {
+		log.Printf("[%s] Log download failed: %v", id, err)
+	}
+}
+
+// GetCredentials returns the generated credentials of a successful
+// deployment. Besides the API token, callers must send the credentials token
+// in the X-Credentials-Token header; it is never accepted as a query parameter.
+func (h *APIHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !validIDRegex.MatchString(id) {
+		http.Error(w, `{"error": "invalid deployment ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.mu.RLock()
+	dep, ok := h.deployments[id]
+	stored := ok && dep.HasCredentials
+	h.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, `{"error": "deployment not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAct(identity(r), dep) {
+		notFoundForeign(w, r)
+		return
+	}
+
+	token := r.Header.Get("X-Credentials-Token")
+	if h.lockedOut(w, r, credentialsRealm, token) {
+		return
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.CredentialsToken)) != 1 {
+		log.Printf("[%s] Rejected credentials request from %s", id, r.RemoteAddr)
+		h.authFailed(r, credentialsRealm, token)
+		http.Error(w, `{"error": "invalid or missing credentials token"}`, http.StatusForbidden)
+		return
+	}
+
+	// Never read a file the deployment no longer claims, such as one an
+	// uninstall failed to delete
+	if !stored {
+		http.Error(w, `{"error": "no credentials stored for this deployment"}`, http.StatusNotFound)
+		return
+	}
+	creds, err := h.creds.Load(id)
+	if err != nil {
+		log.Printf("[%s] Failed to load credentials: %v", id, err)
+		http.Error(w, `{"error": "failed to read stored credentials"}`, http.StatusInternalServerError)
+		return
+	}
+	if creds == nil {
+		http.Error(w, `{"error": "no credentials stored for this deployment"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(creds)
+}
+
+// ==========================================
+// API TOKENS
+// ==========================================
+
+// ListTokens returns the named API tokens, without their secrets.
+func (h *APIHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.tokens.List())
+}
+
+// CreateToken adds a named token with a scope. The secret is returned once
+// and only its hash is stored.
+func (h *APIHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+
+	var req struct {
+		Name  string     `json:"name"`
+		Scope auth.Scope `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !validTokenName.MatchString(req.Name) || req.Name == "admin" {
+		http.Error(w, `{"error": "name must be 1-64 letters, digits or . _ @ - and not 'admin'"}`, http.StatusBadRequest)
+		return
+	}
+	if !req.Scope.Valid() {
+		http.Error(w, `{"error": "scope must be 'read', 'deploy' or 'admin'"}`, http.StatusBadRequest)
+		return
+	}
+
+	token, secret, err := h.tokens.Create(req.Name, req.Scope, identity(r).Name)
+	if errors.Is(err, auth.ErrNameTaken) {
+		jsonError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create token %q: %v", req.Name, err)
+		http.Error(w, `{"error": "failed to create token"}`, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Token %q (%s) created by %s", token.Name, token.Scope, identity(r).Name)
+	auditNote(r).detail = fmt.Sprintf("token %s %q (%s)", token.ID, token.Name, token.Scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"scope":      token.Scope,
+		"created_at": token.CreatedAt,
+		"token":      secret,
+	})
+}
+
+// RevokeToken deletes a named token; requests using it fail from then on.
+func (h *APIHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validTokenID.MatchString(id) {
+		http.Error(w, `{"error": "invalid token ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.tokens.Revoke(id)
+	if err != nil {
+		log.Printf("Failed to revoke token %s: %v", id, err)
+		http.Error(w, `{"error": "failed to revoke token"}`, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, `{"error": "token not found"}`, http.StatusNotFound)
+		return
+	}
+	h.sessions.DeleteForToken(id)
+	log.Printf("Token %s revoked by %s", id, identity(r).Name)
+	auditNote(r).detail = "token " + id
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ==========================================
+// AUDIT LOG
+// ==========================================
+
+// auditKey is the request context key of the *auditNoteData being collected
+// for an audited request.
+type auditKey struct{}
+
+// auditNoteData is what an audited handler learns about the request beyond
+// its route: the deployment it created or touched, the target server, who
+// logged in, and an outcome when the HTTP status does not tell (SSO always
+// redirects).
+type auditNoteData struct {
+	actor        string
+	deploymentID string
+	server       string
+	outcome      string
+	detail       string
+}
+
+// auditNote returns the audit details of r for the handler to fill in. Outside
+// an audited route it returns a throwaway value.
+func auditNote(r *http.Request) *auditNoteData {
+	if note, ok := r.Context().Value(auditKey{}).(*auditNoteData); ok {
+		return note
+	}
+	return &auditNoteData{}
+}
+
+// Audit wraps a handler so every call is recorded in the audit log with the
+// caller, source address, action, target deployment and outcome. Wrap it
+// around RequireScope so refused calls are recorded too.
+func (h *APIHandler) Audit(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now().UTC()
+		note := &auditNoteData{}
+		if strings.HasPrefix(r.URL.Path, "/api/deployments/") {
+			note.deploymentID = mux.Vars(r)["id"]
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		next(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, note)))
+
+		entry := audit.Entry{
+			Time:         started,
+			Actor:        identity(r).Name,
+			SourceIP:     clientIP(r),
+			Action:       action,
+			DeploymentID: note.deploymentID,
+			Server:       note.server,
+			Outcome:      note.outcome,
+			Status:       aw.status,
+			Detail:       note.detail,
+		}
+		if note.actor != "" {
+			entry.Actor = note.actor
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if entry.Outcome == "" {
+			switch {
+			case entry.Status == http.StatusUnauthorized || entry.Status == http.StatusForbidden || entry.Status == http.StatusTooManyRequests:
+				entry.Outcome = audit.OutcomeDenied
+			case entry.Status >= 400:
+				entry.Outcome = audit.OutcomeFailed
+			default:
+				entry.Outcome = audit.OutcomeSuccess
+			}
+		}
+		if entry.Status >= 400 && entry.Detail == "" {
+			var body struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(aw.errBody, &body) == nil {
+				entry.Detail = body.Error
+			}
+		}
+		if entry.Server == "" && entry.DeploymentID != "" {
+			h.mu.RLock()
+			if dep, ok := h.deployments[entry.DeploymentID]; ok {
+				entry.Server = dep.Summary.ServerIP
+			}
+			h.mu.RUnlock()
+		}
+		h.record(entry)
+	}
+}
+
+// record appends to the audit log. A failed write is logged rather than
+// failing the request, which has already been answered.
+func (h *APIHandler) record(entry audit.Entry) {
+	if err := h.audit.Record(entry); err != nil {
+		log.Printf("Failed to write audit entry for %s: %v", entry.Action, err)
+	}
+}
+
+// auditWriter captures the status of an audited response and the start of its
+// body when it is an error, whose message goes into the entry's detail.
+type auditWriter struct {
+	http.ResponseWriter
+	status  int
+	errBody []byte
+}
+
+// maxAuditErrBody bounds how much of an error response is kept.
+const maxAuditErrBody = 512
+
+func (w *auditWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.errBody) < maxAuditErrBody {
+		w.errBody = append(w.errBody, b[:min(len(b), maxAuditErrBody-len(w.errBody))]...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets audited handlers stream (the SSE endpoint needs it).
+func (w *auditWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// clientIP returns the address of the connecting client. Forwarding headers
+// are ignored since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// maxAuditEntries caps the entries returned as JSON; exports are unlimited.
+const maxAuditEntries = 10000
+
+// GetAudit returns audit entries, optionally filtered by time range (since,
+// until as RFC 3339), actor, action and deployment. By default the latest 500
+// matches are returned as a JSON array; format=jsonl exports every match as a
+// JSON lines download.
+func (h *APIHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := audit.Filter{
+		Actor:        q.Get("actor"),
+		Action:       q.Get("action"),
+		DeploymentID: q.Get("deployment"),
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				jsonError(w, p.name+" must be an RFC 3339 time, e.g. 2024-01-02T15:04:05Z", http.StatusBadRequest)
+				return
+			}
+			*p.dst = t
+		}
+	}
+
+	if q.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stackbill-audit-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+		if err := h.audit.Export(w, filter); err != nil {
+			log.Printf("Audit export failed: %v", err)
+		}
+		return
+	}
+
+	limit := 500
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditEntries {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditEntries), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	entries, err := h.audit.Query(filter, limit)
+	if err != nil {
+		log.Printf("Audit query failed: %v", err)
+		http.Error(w, `{"error": "failed to read audit log"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
 }
 
 func generateID() string {
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"stackbill-deployer/internal/audit"
+	"stackbill-deployer/internal/auth"
+	"stackbill-deployer/internal/config"
+	"stackbill-deployer/internal/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+const testAdminToken = "test-admin-token"
+
+// newAuthTestHandler returns a handler with just what AuthMiddleware needs.
+func newAuthTestHandler(t *testing.T) *APIHandler {
+	t.Helper()
+	dir := t.TempDir()
+	tokens, err := auth.OpenTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatalf("opening token store: %v", err)
+	}
+	auditLog, err := audit.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("opening audit log: %v", err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	return &APIHandler{
+		cfg:         &config.Config{AuthToken: testAdminToken},
+		tokens:      tokens,
+		sessions:    auth.NewSessionStore(time.Hour),
+		audit:       auditLog,
+		authLockout: ratelimit.NewLockout(60, 1000, time.Minute),
+	}
+}
+
+// serveAuth runs req through AuthMiddleware in front of a handler that
+// answers 204, and returns the status.
+func serveAuth(h *APIHandler, req *http.Request) int {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity(r).Name == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	rec := httptest.NewRecorder()
+	h.AuthMiddleware(next).ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestCookieSessionRequiresCSRFToken(t *testing.T) {
+	h := newAuthTestHandler(t)
+	session, err := h.sessions.Create(auth.Identity{Name: "admin", Scope: auth.ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		csrf   string
+		want   int
+	}{
+		{"GET", "", http.StatusNoContent},
+		{"POST", "", http.StatusForbidden},
+		{"POST", "wrong", http.StatusForbidden},
+		{"POST", session.CSRFToken + "x", http.StatusForbidden},
+		{"POST", session.CSRFToken, http.StatusNoContent},
+		{"DELETE", "", http.StatusForbidden},
+		{"DELETE", "wrong", http.StatusForbidden},
+		{"DELETE", session.CSRFToken, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/tokens/0123456789abcdef", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.ID})
+		if tt.csrf != "" {
+			req.Header.Set("X-CSRF-Token", tt.csrf)
+		}
+		if got := serveAuth(h, req); got != tt.want {
+			t.Errorf("%s with CSRF token %q: status %d, want %d", tt.method, tt.csrf, got, tt.want)
+		}
+	}
+
+	// Another session's CSRF token is not accepted either
+	other, _ := h.sessions.Create(auth.Identity{Name: "admin", Scope: auth.ScopeAdmin})
+	req := httptest.NewRequest("POST", "/api/deploy", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.ID})
+	req.Header.Set("X-CSRF-Token", other.CSRFToken)
+	if got := serveAuth(h, req); got != http.StatusForbidden {
+		t.Errorf("POST with another session's CSRF token: status %d, want 403", got)
+	}
+}
+
+func TestBearerTokenNeedsNoCSRFToken(t *testing.T) {
+	h := newAuthTestHandler(t)
+	_, secret, err := h.tokens.Create("ci", auth.ScopeDeploy, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{testAdminToken, secret} {
+		for _, method := range []string{"GET", "POST", "DELETE"} {
+			req := httptest.NewRequest(method, "/api/deploy", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if got := serveAuth(h, req); got != http.StatusNoContent {
+				t.Errorf("%s with bearer token: status %d, want 204", method, got)
+			}
+		}
+	}
+}
+
+func TestQueryTokenDoesNotAuthenticate(t *testing.T) {
+	h := newAuthTestHandler(t)
+	_, secret, err := h.tokens.Create("ci", auth.ScopeRead, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{testAdminToken, secret} {
+		for _, path := range []string{"/api/deployments?token=" + token, "/api/deployments/x/stream?token=" + token} {
+			if got := serveAuth(h, httptest.NewRequest("GET", path, nil)); got != http.StatusUnauthorized {
+				t.Errorf("GET %s: status %d, want 401", path, got)
+			}
+		}
+	}
+}
+
+func TestUnknownCredentialsRejected(t *testing.T) {
+	h := newAuthTestHandler(t)
+
+	req := httptest.NewRequest("GET", "/api/deployments", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	if got := serveAuth(h, req); got != http.StatusUnauthorized {
+		t.Errorf("unknown bearer token: status %d, want 401", got)
+	}
+
+	req = httptest.NewRequest("GET", "/api/deployments", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "not-a-session"})
+	if got := serveAuth(h, req); got != http.StatusUnauthorized {
+		t.Errorf("unknown session: status %d, want 401", got)
+	}
+
+	if got := serveAuth(h, httptest.NewRequest("GET", "/api/deployments", nil)); got != http.StatusUnauthorized {
+		t.Errorf("no credentials: status %d, want 401", got)
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	discovery := httptest.NewServer(nil)
+	discovery.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer": "` + discovery.URL + `", "authorization_endpoint": "` + discovery.URL + `/authorize",
+			"token_endpoint": "` + discovery.URL + `/token", "jwks_uri": "` + discovery.URL + `/jwks"}`))
+	})
+	defer discovery.Close()
+	oidc, err := auth.NewOIDC(context.Background(), config.OIDCConfig{Issuer: discovery.URL, ClientID: "deployer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newAuthTestHandler(t)
+	h.oidc = oidc
+	h.ssoLimit = ratelimit.New(ssoLoginsPerMinute, ssoLoginsPerMinute)
+
+	// Starting a login binds its state to the browser
+	rec := httptest.NewRecorder()
+	h.OIDCLogin(rec, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	state := location.Query().Get("state")
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if rec.Code != http.StatusFound || state == "" || cookie == nil {
+		t.Fatalf("login: status %d, state %q, cookie %v", rec.Code, state, cookie)
+	}
+	if cookie.Value != state || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge <= 0 {
+		t.Errorf("state cookie %+v does not hold the state as a short-lived HttpOnly, SameSite=Lax cookie", cookie)
+	}
+
+	// A callback is refused unless the browser's cookie matches its state
+	for _, tt := range []struct{ name, cookie string }{
+		{"no cookie", ""},
+		{"another login's state", "0123456789abcdef0123456789abcdef"},
+	} {
+		req := httptest.NewRequest("GET", "/auth/oidc/callback?code=c&state="+state, nil)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		h.Audit("sso_login", h.OIDCCallback)(rec, req)
+		location := rec.Header().Get("Location")
+		if rec.Code != http.StatusFound || !strings.Contains(location, "login_error=") || !strings.Contains(location, "not+started+in+this+browser") {
+			t.Errorf("%s: status %d, redirect %q, want a login error", tt.name, rec.Code, location)
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie {
+				t.Errorf("%s: callback set a session cookie", tt.name)
+			}
+		}
+	}
+	entries, err := h.audit.Query(audit.Filter{Action: "sso_login"}, 0)
+	if err != nil || len(entries) != 2 || entries[0].Outcome != audit.OutcomeDenied {
+		t.Errorf("audit entries = %+v, %v; want two denied sso_login entries", entries, err)
+	}
+}
+
+func TestOIDCLoginRateLimited(t *testing.T) {
+	h := newAuthTestHandler(t)
+	h.ssoLimit = ratelimit.New(1, 1)
+	// The limiter is checked first, so the refused request never reaches
+	// the (unconfigured) provider
+	h.ssoLimit.Allow("192.0.2.1")
+	rec := httptest.NewRecorder()
+	h.OIDCLogin(rec, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if location := rec.Header().Get("Location"); rec.Code != http.StatusFound || !strings.Contains(location, "login_error=") {
+		t.Fatalf("status %d, redirect %q, want a login error", rec.Code, location)
+	}
+}
+
+func TestInvalidTokensLockOutAddressAndToken(t *testing.T) {
+	h := newAuthTestHandler(t)
+	h.cfg.RateLimit.AuthLockout = time.Minute
+	h.authLockout = ratelimit.NewLockout(1, 2, time.Minute)
+	bearer := func(ip, token string) int {
+		req := httptest.NewRequest("GET", "/api/deployments", nil)
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serveAuth(h, req)
+	}
+
+	// One address trying many tokens is locked out, for every token
+	for i, want := range []int{401, 401, 401, 429} {
+		if got := bearer("192.0.2.1", "guess-"+strconv.Itoa(i)); got != want {
+			t.Errorf("guess %d from one address: status %d, want %d", i, got, want)
+		}
+	}
+	if got := bearer("192.0.2.1", testAdminToken); got != http.StatusTooManyRequests {
+		t.Errorf("valid token from a locked-out address: status %d, want 429", got)
+	}
+
+	// One token retried from many addresses is locked out too
+	for i, want := range []int{401, 401, 401, 429} {
+		if got := bearer("198.51.100."+strconv.Itoa(i+1), "stolen-guess"); got != want {
+			t.Errorf("token retry %d from a new address: status %d, want %d", i, got, want)
+		}
+	}
+
+	// Neither lockout affects a valid token from another address
+	if got := bearer("203.0.113.1", testAdminToken); got != http.StatusNoContent {
+		t.Errorf("valid token from a clean address: status %d, want 204", got)
+	}
+	entries, _ := h.audit.Query(audit.Filter{Action: "lockout"}, 0)
+	if len(entries) != 2 {
+		t.Errorf("%d lockout entries audited, want 2", len(entries))
+	}
+}
+
+func TestCredentialsTokenLockoutIsSeparate(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	h.authLockout = ratelimit.NewLockout(1, 2, time.Minute)
+	admin, _ := h.authenticate(testAdminToken)
+	addDeployment(h, testDeploymentID, admin.Subject)
+	credentials := func(ip, token string) int {
+		req := httptest.NewRequest("GET", "/api/deployments/"+testDeploymentID+"/credentials", nil)
+		req.RemoteAddr = ip + ":40000"
+		req = mux.SetURLVars(req, map[string]string{"id": testDeploymentID})
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, admin))
+		if token != "" {
+			req.Header.Set("X-Credentials-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		h.GetCredentials(rec, req)
+		return rec.Code
+	}
+	bearer := func(ip, token string) int {
+		req := httptest.NewRequest("GET", "/api/deployments", nil)
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serveAuth(h, req)
+	}
+
+	// Guessing the credentials token locks the address out of credentials
+	// reads only, not out of the API
+	for i, want := range []int{403, 403, 403, 429} {
+		if got := credentials("192.0.2.1", "guess-"+strconv.Itoa(i)); got != want {
+			t.Errorf("credentials guess %d: status %d, want %d", i, got, want)
+		}
+	}
+	if got := bearer("192.0.2.1", testAdminToken); got != http.StatusNoContent {
+		t.Errorf("API request from an address locked out of credentials: status %d, want 204", got)
+	}
+
+	// An API token sent as the credentials token is not locked out as an API token
+	for i := 1; i <= 4; i++ {
+		credentials("198.51.100."+strconv.Itoa(i), testAdminToken)
+	}
+	if got := bearer("203.0.113.1", testAdminToken); got != http.StatusNoContent {
+		t.Errorf("API token rejected as credentials token: bearer status %d, want 204", got)
+	}
+
+	// Missing tokens from many addresses do not add up to a shared lockout
+	for i := 1; i <= 4; i++ {
+		if got := credentials("203.0.113."+strconv.Itoa(i+10), ""); got != http.StatusForbidden {
+			t.Errorf("missing credentials token from address %d: status %d, want 403", i, got)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if got := bearer("203.0.113."+strconv.Itoa(i+20), ""); got != http.StatusUnauthorized {
+			t.Errorf("empty bearer token from address %d: status %d, want 401", i, got)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"stackbill-deployer/internal/audit"
+	"stackbill-deployer/internal/auth"
+	"stackbill-deployer/internal/config"
+	"stackbill-deployer/internal/credstore"
+	"stackbill-deployer/internal/logstore"
+	"stackbill-deployer/internal/models"
+	"stackbill-deployer/internal/stages"
+	"stackbill-deployer/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+const testDeploymentID = "20260101-000000-deadbeef"
+
+// newDeploymentTestHandler returns a full handler backed by stores in a temp dir.
+func newDeploymentTestHandler(t *testing.T) *APIHandler {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AnsibleDir:         "ansible",
+		AuthToken:          testAdminToken,
+		DataDir:            dir,
+		Workers:            1,
+		MaxQueued:          1,
+		SessionTTL:         time.Hour,
+		CredentialsToken:   "test-credentials-token",
+		CredentialsKeyFile: filepath.Join(dir, "credentials.key"),
+		RateLimit: config.RateLimitConfig{
+			DeployPerMinute: 6000,
+			DeployBurst:     1000,
+			AuthFailures:    1000,
+			AuthPerMinute:   6000,
+			AuthLockout:     time.Minute,
+		},
+	}
+	manifest, err := stages.Load(filepath.Join("..", "..", "ansible", "stages.yml"))
+	if err != nil {
+		t.Fatalf("loading stage manifest: %v", err)
+	}
+	st, err := store.OpenBolt(filepath.Join(dir, "deployer.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	logs, err := logstore.Open(filepath.Join(dir, "logs"))
+	if err != nil {
+		t.Fatalf("opening log store: %v", err)
+	}
+	creds, err := credstore.Open(filepath.Join(dir, "credentials"), cfg.CredentialsKeyFile)
+	if err != nil {
+		t.Fatalf("opening credentials store: %v", err)
+	}
+	tokens, err := auth.OpenTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatalf("opening token store: %v", err)
+	}
+	auditLog, err := audit.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("opening audit log: %v", err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	return NewAPIHandler(cfg, manifest, st, logs, creds, tokens, nil, auditLog)
+}
+
+// newIdentity creates a named token and returns the identity it authenticates as.
+func newIdentity(t *testing.T, h *APIHandler, name string, scope auth.Scope) auth.Identity {
+	t.Helper()
+	_, secret, err := h.tokens.Create(name, scope, "admin")
+	if err != nil {
+		t.Fatalf("creating token %q: %v", name, err)
+	}
+	id, ok := h.authenticate(secret)
+	if !ok {
+		t.Fatalf("token %q does not authenticate", name)
+	}
+	return id
+}
+
+// addDeployment registers a failed deployment whose settings were lost in a
+// restart, so resume and uninstall stop at 409 instead of connecting anywhere.
+func addDeployment(h *APIHandler, id, owner string, viewers ...string) {
+	now := time.Now()
+	dep := &models.Deployment{
+		ID:           id,
+		Status:       models.StatusFailed,
+		Owner:        owner,
+		Viewers:      viewers,
+		StartedAt:    now.Add(-time.Minute),
+		EndedAt:      &now,
+		CurrentStage: -1,
+	}
+	h.mu.Lock()
+	h.deployments[id] = dep
+	h.appendLog(dep, "first line")
+	h.appendLog(dep, "last line")
+	h.mu.Unlock()
+}
+
+// serveAs calls handler through Audit as caller and returns the response.
+func serveAs(h *APIHandler, caller auth.Identity, handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if parts := strings.Split(path, "/"); len(parts) > 3 {
+		req = mux.SetURLVars(req, map[string]string{"id": strings.SplitN(parts[3], "?", 2)[0]})
+	}
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, caller))
+	rec := httptest.NewRecorder()
+	h.Audit("test", handler)(rec, req)
+	return rec
+}
+
+func TestDeploymentAccess(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	alice := newIdentity(t, h, "alice", auth.ScopeDeploy)
+	bob := newIdentity(t, h, "bob", auth.ScopeDeploy)
+	carol := newIdentity(t, h, "carol", auth.ScopeRead)
+	dave := newIdentity(t, h, "dave", auth.ScopeRead)
+	admin, _ := h.authenticate(testAdminToken)
+	addDeployment(h, testDeploymentID, alice.Subject, carol.Subject)
+
+	// Bob and Dave are told the deployment does not exist; Carol, with whom
+	// it is shared, can see it but not act on it
+	const dep = "/api/deployments/" + testDeploymentID
+	const notFound = http.StatusNotFound
+	tests := []struct {
+		name                           string
+		handler                        http.HandlerFunc
+		method, path, body             string
+		alice, bob, carol, dave, admin int
+	}{
+		{"get", h.GetDeployment, "GET", dep, "", 200, notFound, 200, notFound, 200},
+		{"stream", h.StreamSSE, "GET", dep + "/stream", "", 200, notFound, 200, notFound, 200},
+		{"log", h.DownloadLog, "GET", dep + "/log", "", 200, notFound, 200, notFound, 200},
+		{"resume", h.ResumeDeployment, "POST", dep + "/resume", "{}", 409, notFound, notFound, notFound, 409},
+		{"cancel", h.CancelDeployment, "POST", dep + "/cancel", "", 409, notFound, notFound, notFound, 409},
+		{"uninstall", h.UninstallDeployment, "POST", dep + "/uninstall", "{}", 409, notFound, notFound, notFound, 409},
+		{"share", h.ShareDeployment, "PUT", dep + "/viewers", `{"viewers": ["` + carol.Subject + `"]}`, 200, notFound, notFound, notFound, 200},
+	}
+	for _, tt := range tests {
+		callers := []struct {
+			id   auth.Identity
+			want int
+		}{{alice, tt.alice}, {bob, tt.bob}, {carol, tt.carol}, {dave, tt.dave}, {admin, tt.admin}}
+		for _, c := range callers {
+			if got := serveAs(h, c.id, tt.handler, tt.method, tt.path, tt.body).Code; got != c.want {
+				t.Errorf("%s as %s: status %d, want %d", tt.name, c.id.Name, got, c.want)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		id   auth.Identity
+		want bool
+	}{{alice, true}, {bob, false}, {carol, true}, {dave, false}, {admin, true}} {
+		var deps []models.Deployment
+		rec := serveAs(h, c.id, h.ListDeployments, "GET", "/api/deployments", "")
+		if err := json.NewDecoder(rec.Body).Decode(&deps); err != nil {
+			t.Fatalf("list as %s: %v", c.id.Name, err)
+		}
+		if listed := len(deps) == 1 && deps[0].ID == testDeploymentID; listed != c.want {
+			t.Errorf("list as %s: got %d deployment(s), want listed = %v", c.id.Name, len(deps), c.want)
+		}
+	}
+}
+
+func TestForeignDeploymentLooksMissing(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	alice := newIdentity(t, h, "alice", auth.ScopeDeploy)
+	bob := newIdentity(t, h, "bob", auth.ScopeDeploy)
+	addDeployment(h, testDeploymentID, alice.Subject)
+
+	// A foreign deployment gets the same answer as one that does not exist,
+	// but the audit log records the refusal
+	foreign := serveAs(h, bob, h.GetDeployment, "GET", "/api/deployments/"+testDeploymentID, "")
+	missing := serveAs(h, bob, h.GetDeployment, "GET", "/api/deployments/20260101-000000-0000beef", "")
+	if foreign.Code != http.StatusNotFound || foreign.Code != missing.Code || foreign.Body.String() != missing.Body.String() {
+		t.Errorf("foreign deployment: %d %q; missing deployment: %d %q", foreign.Code, foreign.Body, missing.Code, missing.Body)
+	}
+	entries, err := h.audit.Query(audit.Filter{Actor: "bob"}, 0)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("audit entries = %+v, %v", entries, err)
+	}
+	var denied int
+	for _, e := range entries {
+		if e.Outcome == audit.OutcomeDenied {
+			denied++
+			if e.DeploymentID != testDeploymentID {
+				t.Errorf("denied entry %+v is for the wrong deployment", e)
+			}
+		}
+	}
+	if denied != 1 {
+		t.Errorf("%d denied entries, want 1 for the foreign deployment", denied)
+	}
+}
+
+func TestOwnerSurvivesTokenNameReuse(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	old := newIdentity(t, h, "alice", auth.ScopeDeploy)
+	addDeployment(h, testDeploymentID, old.Subject)
+	if _, err := h.tokens.Revoke(old.TokenID); err != nil {
+		t.Fatal(err)
+	}
+	reused := newIdentity(t, h, "alice", auth.ScopeDeploy)
+
+	if got := serveAs(h, reused, h.GetDeployment, "GET", "/api/deployments/"+testDeploymentID, "").Code; got != http.StatusNotFound {
+		t.Errorf("new token with a reused name: status %d, want 404", got)
+	}
+
+	// Owners recorded by name move to the token only if it already existed
+	// when the deployment started
+	legacy := &models.Deployment{ID: "legacy-before", Owner: "alice", StartedAt: time.Now().Add(-time.Hour)}
+	current := &models.Deployment{ID: "legacy-after", CreatedBy: "alice", StartedAt: time.Now().Add(time.Hour)}
+	h.mu.Lock()
+	h.migrateOwner(legacy)
+	h.migrateOwner(current)
+	h.mu.Unlock()
+	if legacy.Owner != "" {
+		t.Errorf("deployment from before the token was created is owned by %q", legacy.Owner)
+	}
+	if current.Owner != reused.Subject {
+		t.Errorf("deployment owner = %q, want %q", current.Owner, reused.Subject)
+	}
+}
+
+func TestCredentialsDeletedWithDatabases(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	admin, _ := h.authenticate(testAdminToken)
+	read := func(id string) int {
+		req := httptest.NewRequest("GET", "/api/deployments/"+id+"/credentials", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, admin))
+		req.Header.Set("X-Credentials-Token", h.cfg.CredentialsToken)
+		rec := httptest.NewRecorder()
+		h.GetCredentials(rec, req)
+		return rec.Code
+	}
+
+	// Two deployments on the wiped server and one elsewhere
+	for _, d := range []struct{ id, server string }{
+		{"20260101-000000-00000001", "192.0.2.10"},
+		{"20260101-000000-00000002", "192.0.2.10"},
+		{"20260101-000000-00000003", "192.0.2.20"},
+	} {
+		addDeployment(h, d.id, admin.Subject)
+		if err := h.creds.Save(d.id, &models.Credentials{ServerIP: d.server}); err != nil {
+			t.Fatal(err)
+		}
+		h.deployments[d.id].Summary.ServerIP = d.server
+		h.deployments[d.id].HasCredentials = true
+	}
+	if got := read("20260101-000000-00000001"); got != http.StatusOK {
+		t.Fatalf("credentials before uninstall: status %d, want 200", got)
+	}
+	if got := read("20260101-000000-0000beef"); got != http.StatusNotFound {
+		t.Errorf("credentials of an unknown deployment: status %d, want 404", got)
+	}
+
+	uninstall := &models.Deployment{ID: "20260101-000000-00000004", Request: models.DeployRequest{
+		ServerIP:  "192.0.2.10",
+		Type:      models.DeployTypeUninstall,
+		Uninstall: models.UninstallOptions{DeleteDatabases: true},
+	}}
+	h.deployments[uninstall.ID] = uninstall
+	h.deleteCredentials(uninstall)
+
+	for id, want := range map[string]int{
+		"20260101-000000-00000001": http.StatusNotFound,
+		"20260101-000000-00000002": http.StatusNotFound,
+		"20260101-000000-00000003": http.StatusOK,
+	} {
+		if got := read(id); got != want {
+			t.Errorf("credentials of %s after uninstall: status %d, want %d", id, got, want)
+		}
+		stored, _ := h.creds.Load(id)
+		if (stored != nil) != (want == http.StatusOK) || h.deployments[id].HasCredentials != (want == http.StatusOK) {
+			t.Errorf("%s: stored %v, has_credentials %v after uninstall", id, stored != nil, h.deployments[id].HasCredentials)
+		}
+	}
+}
+
+func TestGetDeploymentPagesLog(t *testing.T) {
+	h := newDeploymentTestHandler(t)
+	admin, _ := h.authenticate(testAdminToken)
+	addDeployment(h, testDeploymentID, admin.Subject)
+	h.mu.Lock()
+	dep := h.deployments[testDeploymentID]
+	for i := 2; i < 1200; i++ {
+		h.appendLog(dep, "line "+strconv.Itoa(i))
+	}
+	h.mu.Unlock()
+
+	tests := []struct {
+		query       string
+		start, n    int
+		first, last string
+	}{
+		{"", 1200 - recentLogLines, recentLogLines, "line 700", "line 1199"},
+		{"?since=0", 0, recentLogLines, "first line", "line 499"},
+		{"?since=1100", 1100, 100, "line 1100", "line 1199"},
+		{"?since=1200", 1200, 0, "", ""},
+		{"?since=5000", 1200, 0, "", ""},
+	}
+	for _, tt := range tests {
+		rec := serveAs(h, admin, h.GetDeployment, "GET", "/api/deployments/"+testDeploymentID+tt.query, "")
+		var resp models.Deployment
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if resp.LogStart != tt.start || len(resp.Logs) != tt.n || resp.LogCount != 1200 {
+			t.Errorf("%q: log_start %d, %d lines of %d; want %d, %d of 1200", tt.query, resp.LogStart, len(resp.Logs), resp.LogCount, tt.start, tt.n)
+			continue
+		}
+		if tt.n > 0 && (resp.Logs[0] != tt.first || resp.Logs[tt.n-1] != tt.last) {
+			t.Errorf("%q: lines %q to %q, want %q to %q", tt.query, resp.Logs[0], resp.Logs[tt.n-1], tt.first, tt.last)
+		}
+	}
+	for _, bad := range []string{"?since=-1", "?since=x"} {
+		if got := serveAs(h, admin, h.GetDeployment, "GET", "/api/deployments/"+testDeploymentID+bad, "").Code; got != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", bad, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package logstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChunkLines is the number of lines per chunk file. All chunks except the
+// last are full, so a line's chunk is simply index / ChunkLines.
+const ChunkLines = 1000
+
+// Store appends deployment logs to chunked files under dir/<id>/NNNNNN.log.
+type Store struct {
+	dir     string
+	mu      sync.Mutex
+	writers map[string]*chunkWriter
+}
+
+type chunkWriter struct {
+	f     *os.File
+	total int // Lines written across all chunks
+}
+
+// Open creates the log directory if needed and returns a Store rooted at it.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	return &Store{dir: dir, writers: make(map[string]*chunkWriter)}, nil
+}
+
+// Append writes lines to the deployment's log and returns the new line count.
+func (s *Store) Append(id string, lines ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, err := s.writer(id)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		// Roll over to the next chunk once the current one is full
+		if w.total > 0 && w.total%ChunkLines == 0 {
+			w.f.Close()
+			if w.f, err = s.openChunk(id, w.total/ChunkLines); err != nil {
+				delete(s.writers, id)
+				return w.total, err
+			}
+		}
+		// One line per record; embedded newlines would shift every later index
+		line = strings.ReplaceAll(line, "\n", " ")
+		if _, err := w.f.WriteString(line + "\n"); err != nil {
+			return w.total, fmt.Errorf("failed to write log: %w", err)
+		}
+		w.total++
+	}
+	return w.total, nil
+}
+
+// Count returns the number of lines stored for a deployment.
+func (s *Store) Count(id string) (int, error) {
+	s.mu.Lock()
+	if w, ok := s.writers[id]; ok {
+		s.mu.Unlock()
+		return w.total, nil
+	}
+	s.mu.Unlock()
+	return s.countOnDisk(id)
+}
+
+// Read calls fn for every stored line starting at index from, in order.
+// A trailing partial line (still being written) is not returned.
+func (s *Store) Read(id string, from int, fn func(index int, line string) error) error {
+	chunks, err := s.chunks(id)
+	if err != nil {
+		return err
+	}
+
+	for c := from / ChunkLines; c < len(chunks); c++ {
+		f, err := os.Open(s.chunkPath(id, c))
+		if err != nil {
+			return fmt.Errorf("failed to open log chunk: %w", err)
+		}
+		r := bufio.NewReader(f)
+		for index := c * ChunkLines; ; index++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				f.Close()
+				if err == io.EOF {
+					break
+				}
+				return fmt.Errorf("failed to read log chunk: %w", err)
+			}
+			if index < from {
+				continue
+			}
+			if err := fn(index, strings.TrimSuffix(line, "\n")); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Finish closes the deployment's open chunk file. Later appends reopen it.
+func (s *Store) Finish(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.writers[id]
+	if !ok {
+		return nil
+	}
+	delete(s.writers, id)
+	return w.f.Close()
+}
+
+// writer returns the open writer for id, resuming after existing lines. Caller holds s.mu.
+func (s *Store) writer(id string) (*chunkWriter, error) {
+	if w, ok := s.writers[id]; ok {
+		return w, nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, id), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	total, err := s.countOnDisk(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.openChunk(id, total/ChunkLines)
+	if err != nil {
+		return nil, err
+	}
+	w := &chunkWriter{f: f, total: total}
+	s.writers[id] = w
+	return w, nil
+}
+
+func (s *Store) openChunk(id string, chunk int) (*os.File, error) {
+	f, err := os.OpenFile(s.chunkPath(id, chunk), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log chunk: %w", err)
+	}
+	return f, nil
+}
+
+func (s *Store) chunkPath(id string, chunk int) string {
+	return filepath.Join(s.dir, id, fmt.Sprintf("%06d.log", chunk))
+}
+
+// chunks returns the chunk file names for id, in order.
+func (s *Store) chunks(id string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list log chunks: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".log") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Store) countOnDisk(id string) (int, error) {
+	chunks, err := s.chunks(id)
+	if err != nil || len(chunks) == 0 {
+		return 0, err
+	}
+	last := len(chunks) - 1
+	data, err := os.ReadFile(s.chunkPath(id, last))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read log chunk: %w", err)
+	}
+	return last*ChunkLines + strings.Count(string(data), "\n"), nil
+}
@@ -0,0 +1,156 @@
+package logstore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readFrom returns the lines Read passes to fn from index from, checking
+// that their indexes are consecutive.
+func readFrom(t *testing.T, s *Store, id string, from int) []string {
+	t.Helper()
+	var lines []string
+	err := s.Read(id, from, func(index int, line string) error {
+		if index != from+len(lines) {
+			t.Fatalf("Read passed index %d, want %d", index, from+len(lines))
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read(%d): %v", from, err)
+	}
+	return lines
+}
+
+func appendLines(t *testing.T, s *Store, id string, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if _, err := s.Append(id, "line "+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestAppendRollsOverChunks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, s, "dep", 0, ChunkLines+5)
+
+	chunks, err := s.chunks("dep")
+	if err != nil || len(chunks) != 2 {
+		t.Fatalf("chunks = %v, %v; want 2", chunks, err)
+	}
+	first, err := os.ReadFile(filepath.Join(dir, "dep", chunks[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(first), "\n"); n != ChunkLines {
+		t.Errorf("first chunk holds %d lines, want %d", n, ChunkLines)
+	}
+
+	// A new store, as after a restart, counts from disk and keeps appending
+	// to the last chunk
+	if err := s.Finish("dep"); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Count("dep"); err != nil || n != ChunkLines+5 {
+		t.Fatalf("Count after reopen = %d, %v", n, err)
+	}
+	appendLines(t, s, "dep", ChunkLines+5, ChunkLines)
+	if n, err := s.Count("dep"); err != nil || n != 2*ChunkLines+5 {
+		t.Fatalf("Count = %d, %v; want %d", n, err, 2*ChunkLines+5)
+	}
+	if chunks, _ := s.chunks("dep"); len(chunks) != 3 {
+		t.Errorf("%d chunks after %d lines, want 3", len(chunks), 2*ChunkLines+5)
+	}
+	lines := readFrom(t, s, "dep", 0)
+	if len(lines) != 2*ChunkLines+5 || lines[ChunkLines] != "line "+strconv.Itoa(ChunkLines) || lines[len(lines)-1] != "line "+strconv.Itoa(2*ChunkLines+4) {
+		t.Errorf("read %d lines back, around the rollover %q", len(lines), lines[ChunkLines-1:ChunkLines+1])
+	}
+}
+
+func TestReadFromCursor(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, s, "dep", 0, ChunkLines+10)
+
+	for _, from := range []int{0, 7, ChunkLines - 1, ChunkLines, ChunkLines + 9} {
+		lines := readFrom(t, s, "dep", from)
+		if len(lines) != ChunkLines+10-from || lines[0] != "line "+strconv.Itoa(from) {
+			t.Errorf("Read(%d): %d lines starting %q", from, len(lines), lines[0])
+		}
+	}
+	for _, from := range []int{ChunkLines + 10, 5 * ChunkLines} {
+		if lines := readFrom(t, s, "dep", from); len(lines) != 0 {
+			t.Errorf("Read(%d) past the end returned %d lines", from, len(lines))
+		}
+	}
+	if lines := readFrom(t, s, "missing", 0); len(lines) != 0 {
+		t.Errorf("Read of an unknown log returned %d lines", len(lines))
+	}
+}
+
+func TestLinesStayOneRecordEach(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append("dep", "first\nsecond", "third"); err != nil {
+		t.Fatal(err)
+	}
+	// A line still being written is not returned
+	f, err := os.OpenFile(s.chunkPath("dep", 0), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("partial")
+	f.Close()
+
+	lines := readFrom(t, s, "dep", 0)
+	if len(lines) != 2 || lines[0] != "first second" || lines[1] != "third" {
+		t.Errorf("lines = %q", lines)
+	}
+}
+
+func TestRingWrapsAround(t *testing.T) {
+	// A ring for a log that already holds 10 lines
+	r := NewRing(3, 10)
+	if lines, ok := r.Since(10); !ok || len(lines) != 0 {
+		t.Errorf("empty ring: Since(10) = %q, %v", lines, ok)
+	}
+	if _, ok := r.Since(9); ok {
+		t.Error("empty ring claims to hold a line written before it")
+	}
+
+	for i := 10; i < 15; i++ {
+		r.Add("line " + strconv.Itoa(i))
+	}
+	// Lines 10 and 11 were evicted; 12 to 14 wrapped around the buffer
+	if _, ok := r.Since(11); ok {
+		t.Error("Since(11) claims an evicted line")
+	}
+	lines, ok := r.Since(12)
+	if !ok || strings.Join(lines, ",") != "line 12,line 13,line 14" {
+		t.Errorf("Since(12) = %q, %v", lines, ok)
+	}
+	if lines, ok := r.Since(14); !ok || len(lines) != 1 || lines[0] != "line 14" {
+		t.Errorf("Since(14) = %q, %v", lines, ok)
+	}
+	if lines, ok := r.Since(15); !ok || len(lines) != 0 {
+		t.Errorf("Since(15) = %q, %v", lines, ok)
+	}
+}
@@ -0,0 +1,35 @@
+package logstore
+
+// Ring keeps the most recent lines of a log in memory, indexed by their
+// absolute position in the log, so live readers avoid going to disk.
+type Ring struct {
+	lines []string
+	held  int // Lines currently in the ring
+	total int // Index of the next line
+}
+
+// NewRing returns a ring holding at most size lines, starting at index start.
+func NewRing(size, start int) *Ring {
+	return &Ring{lines: make([]string, size), total: start}
+}
+
+// Add appends a line, evicting the oldest once the ring is full.
+func (r *Ring) Add(line string) {
+	r.lines[r.total%len(r.lines)] = line
+	r.total++
+	if r.held < len(r.lines) {
+		r.held++
+	}
+}
+
+// Since returns the lines from index from onward. ok is false when some of
+// those lines have already been evicted and must be read from disk.
+func (r *Ring) Since(from int) (lines []string, ok bool) {
+	if from < r.total-r.held {
+		return nil, false
+	}
+	for i := from; i < r.total; i++ {
+		lines = append(lines, r.lines[i%len(r.lines)])
+	}
+	return lines, true
+}
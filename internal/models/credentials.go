@@ -0,0 +1,39 @@
+package models
+
+// Credentials are the generated service credentials of an installation, parsed
+// from /etc/stackbill/<domain>/credentials.txt on the target server.
+type Credentials struct {
+	PortalURL  string             `json:"portal_url"`
+	ServerIP   string             `json:"server_ip"`
+	MySQL      ServiceCredentials `json:"mysql"`
+	MongoDB    ServiceCredentials `json:"mongodb"`
+	RabbitMQ   ServiceCredentials `json:"rabbitmq"`
+	NFS        NFSExport          `json:"nfs"`
+	CloudStack *CloudStackAccess  `json:"cloudstack,omitempty"` // Simulator deployments only
+}
+
+// ServiceCredentials are the connection details of a host database or broker.
+type ServiceCredentials struct {
+	Host          string `json:"host"`
+	Port          string `json:"port"`
+	Database      string `json:"database,omitempty"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	ManagementURL string `json:"management_url,omitempty"`
+}
+
+type NFSExport struct {
+	Server string `json:"server"`
+	Path   string `json:"path"`
+}
+
+// CloudStackAccess holds the simulator endpoints and the StackBill admin user.
+// Fields the playbook could not generate are left empty.
+type CloudStackAccess struct {
+	URL       string `json:"url"`
+	APIURL    string `json:"api_url"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	APIKey    string `json:"api_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+}
@@ -1,18 +1,51 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type DeploymentStatus string
 
 const (
 	StatusPending     DeploymentStatus = "pending"
+	StatusQueued      DeploymentStatus = "queued"
 	StatusRunning     DeploymentStatus = "running"
 	StatusSuccess     DeploymentStatus = "success"
 	StatusFailed      DeploymentStatus = "failed"
 	StatusInterrupted DeploymentStatus = "interrupted"
+	StatusCancelled   DeploymentStatus = "cancelled"
 )
 
+// IsFinished reports whether the deployment has reached a terminal status.
+func (s DeploymentStatus) IsFinished() bool {
+	switch s {
+	case StatusSuccess, StatusFailed, StatusInterrupted, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Deployment types
+const (
+	DeployTypeInstall   = "install"   // Full installation, infrastructure included
+	DeployTypeUpgrade   = "upgrade"   // New chart version on an existing installation
+	DeployTypeUninstall = "uninstall" // Removal of an installation (uninstall.yml)
+)
+
+// UninstallOptions mirror the flags of scripts/uninstall.sh. The Helm release
+// and Istio resources are always removed; everything else is kept by default.
+type UninstallOptions struct {
+	DeletePVC       bool `json:"delete_pvc"`
+	DeleteNamespace bool `json:"delete_namespace"`
+	DeleteDatabases bool `json:"delete_databases"` // MariaDB, MongoDB, RabbitMQ, NFS data and saved credentials
+	RemoveSimulator bool `json:"remove_simulator"`
+}
+
 type DeployRequest struct {
+	Type         string `json:"type"`          // DeployTypeInstall (default) or DeployTypeUpgrade; uninstalls have their own endpoint
+	ChartVersion string `json:"chart_version"` // StackBill Helm chart version; latest when empty (required for upgrades)
+
 	ServerIP   string `json:"server_ip"`
 	SSHUser    string `json:"ssh_user"`
 	SSHPass    string `json:"ssh_pass"`
@@ -20,6 +53,26 @@ type DeployRequest struct {
 	SSHPort    int    `json:"ssh_port"`
 	Domain     string `json:"domain"`
 
+	// SSH key authentication (PEM content, written to a per-deployment temp file)
+	SSHKey           string `json:"ssh_key"`
+	SSHKeyPassphrase string `json:"ssh_key_passphrase"`
+
+	// Jump host (bastion) for targets on private networks
+	JumpHost          string `json:"jump_host"`
+	JumpPort          int    `json:"jump_port"`
+	JumpUser          string `json:"jump_user"`
+	JumpPass          string `json:"jump_pass"`
+	JumpKey           string `json:"jump_key"`
+	JumpKeyPassphrase string `json:"jump_key_passphrase"`
+
+	// Additional K3s cluster nodes; ServerIP is always the first server node.
+	// Nodes share the target server's SSH credentials and jump host.
+	Nodes []Node `json:"nodes"`
+
+	// Host key fingerprints the user confirmed for hosts the deployer has not
+	// connected to before, keyed by known_hosts address ("host" or "[host]:port")
+	HostKeys map[string]string `json:"host_keys"`
+
 	// SSL Configuration
 	SSLMode          string `json:"ssl_mode"`
 	SSLCert          string `json:"ssl_cert"`
@@ -32,88 +85,148 @@ type DeployRequest struct {
 
 	// ECR Token
 	ECRToken string `json:"ecr_token"`
+
+	// Uninstall options; only set for DeployTypeUninstall runs
+	Uninstall UninstallOptions `json:"-"`
+
+	// Roles restricts the run to these Ansible roles (used when resuming); empty runs the full playbook
+	Roles []string `json:"-"`
 }
 
 // DeploymentSummary contains only safe, non-sensitive fields for API responses.
 type DeploymentSummary struct {
+	Type           string `json:"type"`
+	ChartVersion   string `json:"chart_version,omitempty"`
 	ServerIP       string `json:"server_ip"`
 	SSHUser        string `json:"ssh_user"`
 	SSHPort        int    `json:"ssh_port"`
+	SSHAuth        string `json:"ssh_auth"` // "password" or "key"
+	JumpHost       string `json:"jump_host,omitempty"`
+	JumpPort       int    `json:"jump_port,omitempty"`
+	JumpUser       string `json:"jump_user,omitempty"`
 	Domain         string `json:"domain"`
 	SSLMode        string `json:"ssl_mode"`
 	CloudStackMode string `json:"cloudstack_mode"`
+	Nodes          []Node `json:"nodes,omitempty"`
+
+	Uninstall *UninstallOptions `json:"uninstall,omitempty"`
+
+	// Pinned SHA256 host key fingerprints, keyed by known_hosts address
+	HostKeys map[string]string `json:"host_keys,omitempty"`
 }
 
 // NewSummary creates a safe summary from a deploy request (no secrets).
 func NewSummary(req DeployRequest) DeploymentSummary {
+	sshAuth := "password"
+	if req.SSHKey != "" {
+		sshAuth = "key"
+	}
+	var uninstall *UninstallOptions
+	if req.Type == DeployTypeUninstall {
+		opts := req.Uninstall
+		uninstall = &opts
+	}
 	return DeploymentSummary{
+		Type:           req.Type,
+		ChartVersion:   req.ChartVersion,
 		ServerIP:       req.ServerIP,
 		SSHUser:        req.SSHUser,
 		SSHPort:        req.SSHPort,
+		SSHAuth:        sshAuth,
+		JumpHost:       req.JumpHost,
+		JumpPort:       req.JumpPort,
+		JumpUser:       req.JumpUser,
 		Domain:         req.Domain,
 		SSLMode:        req.SSLMode,
 		CloudStackMode: req.CloudStackMode,
+		Nodes:          req.Nodes,
+		Uninstall:      uninstall,
+	}
+}
+
+// K3s node roles
+const (
+	NodeRoleServer = "server"
+	NodeRoleAgent  = "agent"
+)
+
+// Node is an additional K3s cluster member.
+type Node struct {
+	Host string `json:"host"`
+	Role string `json:"role"` // "server" or "agent"
+}
+
+// NodeStatus tracks which stage a cluster node is on.
+type NodeStatus struct {
+	Host    string `json:"host"`
+	Role    string `json:"role"`
+	Primary bool   `json:"primary,omitempty"` // The target server; runs every stage
+	Stage   string `json:"stage"`             // Name of the stage the node last worked on
+	Status  string `json:"status"`            // "pending", "running", "done", "error", "cancelled"
+}
+
+// Hosts returns every host a deployment connects to: the target server, then
+// any cluster nodes.
+func (r DeployRequest) Hosts() []string {
+	hosts := []string{strings.ToLower(r.ServerIP)}
+	for _, n := range r.Nodes {
+		hosts = append(hosts, strings.ToLower(n.Host))
 	}
+	return hosts
+}
+
+// BuildNodes returns the pending node list for a deployment, target server
+// first, or nil for a single-server deployment.
+func BuildNodes(req DeployRequest) []NodeStatus {
+	if len(req.Nodes) == 0 {
+		return nil
+	}
+	nodes := []NodeStatus{{Host: req.ServerIP, Role: NodeRoleServer, Primary: true, Status: "pending"}}
+	for _, n := range req.Nodes {
+		nodes = append(nodes, NodeStatus{Host: n.Host, Role: n.Role, Status: "pending"})
+	}
+	return nodes
 }
 
 type Stage struct {
-	Name     string `json:"name"`
-	MatchKey string `json:"-"`      // Used for log line matching; falls back to Name if empty
-	Status   string `json:"status"` // "pending", "running", "done", "error"
+	Name   string `json:"name"`
+	Role   string `json:"role"`   // Ansible role that implements this stage
+	Status string `json:"status"` // "pending", "running", "done", "error", "cancelled"
 }
 
 type Deployment struct {
-	ID           string            `json:"id"`
-	Request      DeployRequest     `json:"-"`       // Internal only — never serialized
-	Summary      DeploymentSummary `json:"config"`  // Safe subset for API
-	Status       DeploymentStatus  `json:"status"`
-	StartedAt    time.Time         `json:"started_at"`
-	EndedAt      *time.Time        `json:"ended_at,omitempty"`
-	Logs         []string          `json:"logs,omitempty"`
-	Stages       []Stage           `json:"stages"`
-	CurrentStage int               `json:"current_stage"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parent_id,omitempty"`    // Deployment this run was resumed from
+	ResumedFrom   string            `json:"resumed_from,omitempty"` // Stage name the resumed run started at
+	Request       DeployRequest     `json:"-"`                      // Internal only — never serialized
+	Summary       DeploymentSummary `json:"config"`                 // Safe subset for API
+	Status        DeploymentStatus  `json:"status"`
+	CreatedBy     string            `json:"created_by,omitempty"`     // Name of the API token that started this run
+	Owner         string            `json:"owner,omitempty"`          // Subject the deployment belongs to; resumed and uninstall runs keep the parent's owner
+	Viewers       []string          `json:"viewers,omitempty"`        // Further subjects allowed to see the deployment
+	QueuePosition int               `json:"queue_position,omitempty"` // 1-based while queued; filled for API responses only
+	StartedAt     time.Time         `json:"started_at"`
+	EndedAt       *time.Time        `json:"ended_at,omitempty"`
+	Logs          []string          `json:"logs,omitempty"`      // A page of the log, filled for API responses only
+	LogStart      int               `json:"log_start,omitempty"` // Index of the first line in Logs
+	LogCount      int               `json:"log_count"`           // Total log lines written
+	Stages        []Stage           `json:"stages"`
+	CurrentStage  int               `json:"current_stage"`
+	Nodes         []NodeStatus      `json:"nodes,omitempty"` // Per-node progress for multi-node clusters
+
+	HasCredentials bool `json:"has_credentials,omitempty"` // Generated credentials are stored for this run
 }
 
-// BuildStages returns the ordered list of deployment stages matching script execution order.
-func BuildStages(req DeployRequest) []Stage {
-	stages := []Stage{
-		{Name: "Checking System Requirements", Status: "pending"},
-		{Name: "Installing K3s", Status: "pending"},
-		{Name: "Installing Helm", Status: "pending"},
-		{Name: "Installing Istio", Status: "pending"},
-	}
-	if req.SSLMode == "letsencrypt" {
-		stages = append(stages,
-			Stage{Name: "Installing Certbot", Status: "pending"},
-			Stage{Name: "Generating SSL Certificate", MatchKey: "Generating Let's Encrypt SSL Certificate", Status: "pending"},
-			Stage{Name: "Setting up Certificate Renewal", MatchKey: "Setting up Automatic Certificate Renewal", Status: "pending"},
-		)
+// ResumeIndex returns the index of the stage a resumed run should start from:
+// the first stage that failed, was cancelled or was interrupted, falling back to the current stage.
+func (d *Deployment) ResumeIndex() int {
+	for i, s := range d.Stages {
+		if s.Status == "error" || s.Status == "cancelled" || s.Status == "interrupted" {
+			return i
+		}
 	}
-	stages = append(stages,
-		Stage{Name: "Installing MariaDB", Status: "pending"},
-		Stage{Name: "Installing MongoDB", Status: "pending"},
-		Stage{Name: "Installing RabbitMQ", Status: "pending"},
-		Stage{Name: "Setting up NFS", Status: "pending"},
-	)
-	stages = append(stages,
-		Stage{Name: "Setting up Namespace", MatchKey: "Setting up Kubernetes Namespace", Status: "pending"},
-		Stage{Name: "Setting up Deployment Credentials", Status: "pending"},
-		Stage{Name: "Setting up TLS Secret", Status: "pending"},
-		Stage{Name: "Deploying StackBill", Status: "pending"},
-		Stage{Name: "Setting up Istio Gateway", Status: "pending"},
-		Stage{Name: "Waiting for Pods", MatchKey: "Waiting for StackBill Pods", Status: "pending"},
-	)
-	// CloudStack simulator runs AFTER pods are ready
-	if req.CloudStackMode == "simulator" {
-		stages = append(stages,
-			Stage{Name: "Installing Podman", Status: "pending"},
-			Stage{Name: "Deploying CloudStack Simulator", Status: "pending"},
-			Stage{Name: "Configuring CloudStack", MatchKey: "Configuring CloudStack RabbitMQ", Status: "pending"},
-			Stage{Name: "Creating CloudStack User", MatchKey: "Creating CloudStack Admin User for StackBill", Status: "pending"},
-		)
+	if d.CurrentStage >= 0 && d.CurrentStage < len(d.Stages) {
+		return d.CurrentStage
 	}
-	stages = append(stages,
-		Stage{Name: "Saving Credentials", Status: "pending"},
-	)
-	return stages
+	return 0
 }
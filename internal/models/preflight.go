@@ -0,0 +1,44 @@
+package models
+
+// PreflightStatus is the outcome of a single pre-flight check.
+type PreflightStatus string
+
+const (
+	PreflightPass PreflightStatus = "pass"
+	PreflightWarn PreflightStatus = "warn"
+	PreflightFail PreflightStatus = "fail"
+)
+
+// rank orders statuses from best to worst.
+func (s PreflightStatus) rank() int {
+	switch s {
+	case PreflightFail:
+		return 2
+	case PreflightWarn:
+		return 1
+	}
+	return 0
+}
+
+// PreflightCheck is one item of a pre-flight report.
+type PreflightCheck struct {
+	Host     string          `json:"host,omitempty"` // Empty for checks run from the deployer itself
+	Category string          `json:"category"`       // "ssh", "system", "network" or "dns"
+	Name     string          `json:"name"`
+	Status   PreflightStatus `json:"status"`
+	Message  string          `json:"message"`
+}
+
+// PreflightReport is the result of POST /api/preflight.
+type PreflightReport struct {
+	Status PreflightStatus  `json:"status"` // Worst status of all checks
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// Add appends a check and updates the overall status.
+func (r *PreflightReport) Add(check PreflightCheck) {
+	r.Checks = append(r.Checks, check)
+	if r.Status == "" || check.Status.rank() > r.Status.rank() {
+		r.Status = check.Status
+	}
+}
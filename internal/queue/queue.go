@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrFull is returned by Enqueue when the queue already holds its maximum
+// number of waiting jobs.
+var ErrFull = errors.New("deployment queue is full")
+
+// Job is a unit of work run by the worker pool.
+type Job struct {
+	ID   string
+	Keys []string // Jobs sharing any key run one at a time, in submission order
+	Run  func()
+}
+
+// Queue runs jobs in FIFO order on a fixed pool of workers. A job with a key
+// that is already running waits without blocking jobs for other keys behind it.
+type Queue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	waiting  []*Job
+	running  map[string]bool // Keys with a job in progress
+	maxWait  int
+	onChange func()
+}
+
+// New starts workers goroutines. maxWaiting limits the number of jobs that may
+// wait at once (0 means unlimited). onChange, if set, is called whenever the
+// set of waiting jobs changes so callers can refresh queue positions.
+func New(workers, maxWaiting int, onChange func()) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &Queue{
+		running:  make(map[string]bool),
+		maxWait:  maxWaiting,
+		onChange: onChange,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue adds a job to the back of the queue.
+func (q *Queue) Enqueue(job *Job) error {
+	q.mu.Lock()
+	if q.maxWait > 0 && len(q.waiting) >= q.maxWait {
+		q.mu.Unlock()
+		return ErrFull
+	}
+	q.waiting = append(q.waiting, job)
+	q.mu.Unlock()
+
+	q.cond.Signal()
+	q.changed()
+	return nil
+}
+
+// Remove drops a job that has not started yet. It reports whether the job
+// was still waiting.
+func (q *Queue) Remove(id string) bool {
+	q.mu.Lock()
+	removed := false
+	for i, job := range q.waiting {
+		if job.ID == id {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	if removed {
+		q.changed()
+	}
+	return removed
+}
+
+// Position returns the 1-based position of a waiting job, or 0 if the job is
+// not waiting.
+func (q *Queue) Position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.waiting {
+		if job.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// work runs jobs until the process exits.
+func (q *Queue) work() {
+	for {
+		q.mu.Lock()
+		job := q.next()
+		for job == nil {
+			q.cond.Wait()
+			job = q.next()
+		}
+		for _, key := range job.Keys {
+			q.running[key] = true
+		}
+		q.mu.Unlock()
+		q.changed()
+
+		job.Run()
+
+		q.mu.Lock()
+		for _, key := range job.Keys {
+			delete(q.running, key)
+		}
+		q.mu.Unlock()
+		// A job for the same keys may now be runnable
+		q.cond.Broadcast()
+	}
+}
+
+// next removes and returns the first waiting job whose keys are all idle.
+// Keys of jobs it passes over stay reserved, so a later job cannot overtake
+// an earlier one it shares a key with. Caller must hold q.mu.
+func (q *Queue) next() *Job {
+	reserved := make(map[string]bool)
+	for i, job := range q.waiting {
+		runnable := true
+		for _, key := range job.Keys {
+			if q.running[key] || reserved[key] {
+				runnable = false
+			}
+		}
+		if runnable {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return job
+		}
+		for _, key := range job.Keys {
+			reserved[key] = true
+		}
+	}
+	return nil
+}
+
+func (q *Queue) changed() {
+	if q.onChange != nil {
+		q.onChange()
+	}
+}
@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder notes the order jobs start in and which keys run at once.
+type recorder struct {
+	mu      sync.Mutex
+	started []string
+	running map[string]bool
+	overlap []string
+}
+
+func (r *recorder) job(id string, release <-chan struct{}, keys ...string) *Job {
+	return &Job{ID: id, Keys: keys, Run: func() {
+		r.mu.Lock()
+		r.started = append(r.started, id)
+		for _, k := range keys {
+			if r.running[k] {
+				r.overlap = append(r.overlap, id+" on "+k)
+			}
+			r.running[k] = true
+		}
+		r.mu.Unlock()
+		<-release
+		r.mu.Lock()
+		for _, k := range keys {
+			delete(r.running, k)
+		}
+		r.mu.Unlock()
+	}}
+}
+
+func (r *recorder) waitStarted(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		started := append([]string(nil), r.started...)
+		r.mu.Unlock()
+		if len(started) >= n {
+			return started
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("only %v started, want %d jobs", r.started, n)
+	return nil
+}
+
+func TestJobsSharingAnyKeyRunOneAtATime(t *testing.T) {
+	r := &recorder{running: make(map[string]bool)}
+	q := New(4, 0, nil)
+	first, second, third := make(chan struct{}), make(chan struct{}), make(chan struct{})
+
+	// A multi-node job holds its server and its extra node
+	q.Enqueue(r.job("cluster", first, "10.0.0.1", "10.0.0.9"))
+	r.waitStarted(t, 1)
+	// Another cluster sharing only the extra node must wait for it, and a
+	// later job for a free host still runs
+	q.Enqueue(r.job("other-cluster", second, "10.0.0.2", "10.0.0.9"))
+	q.Enqueue(r.job("free", third, "10.0.0.3"))
+	if started := r.waitStarted(t, 2); started[1] != "free" {
+		t.Fatalf("started %v, want the free host to run next", started)
+	}
+	if q.Position("other-cluster") != 1 {
+		t.Errorf("overlapping job is not waiting")
+	}
+
+	close(first)
+	r.waitStarted(t, 3)
+	close(second)
+	close(third)
+	if len(r.overlap) > 0 {
+		t.Errorf("jobs ran at once on a shared key: %v", r.overlap)
+	}
+}
+
+func TestWaitingJobReservesItsKeys(t *testing.T) {
+	r := &recorder{running: make(map[string]bool)}
+	q := New(4, 0, nil)
+	release := make(chan struct{})
+	defer close(release)
+
+	// "wide" waits for a; "narrow" needs only b, which is idle, but was
+	// submitted after "wide" and shares b with it, so it must not overtake
+	q.Enqueue(r.job("holder", release, "a"))
+	r.waitStarted(t, 1)
+	q.Enqueue(r.job("wide", release, "a", "b"))
+	q.Enqueue(r.job("narrow", release, "b"))
+	time.Sleep(20 * time.Millisecond)
+	if got := q.Position("narrow"); got != 2 {
+		t.Errorf("narrow job position = %d, want 2 behind the wide job", got)
+	}
+}
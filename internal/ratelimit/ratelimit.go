@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often idle buckets and expired lockouts are dropped.
+const pruneInterval = time.Minute
+
+// Limiter is a token-bucket rate limiter keyed by client (IP address, token
+// name, ...). Each key's bucket holds up to burst tokens and refills at rate
+// tokens per second.
+type Limiter struct {
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing perMinute requests per minute per key, with
+// bursts of up to burst requests.
+func New(perMinute, burst int) *Limiter {
+	return &Limiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of every key, or from none of them if
+// any is empty. In that case it also returns how long until all of them have
+// a token again.
+func (l *Limiter) Allow(keys ...string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	var wait time.Duration
+	for _, key := range keys {
+		b := l.refill(key, now)
+		if b.tokens < 1 {
+			if d := time.Duration((1 - b.tokens) / l.rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, key := range keys {
+		l.buckets[key].tokens--
+	}
+	return true, 0
+}
+
+// refill returns key's bucket topped up for the time elapsed since its last use.
+// Caller must hold l.mu.
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// prune drops buckets that have refilled completely; they behave exactly like
+// new ones. Caller must hold l.mu.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Lockout blocks a key for a fixed time once its failures exhaust a token
+// bucket: each failure takes a token, so a burst of failures locks the key
+// while occasional mistakes never do.
+type Lockout struct {
+	failures *Limiter
+	duration time.Duration
+	mu       sync.Mutex
+	until    map[string]time.Time
+}
+
+// NewLockout locks a key out for duration once it has more than burst
+// failures in quick succession; the allowance refills at perMinute per minute.
+func NewLockout(perMinute, burst int, duration time.Duration) *Lockout {
+	return &Lockout{
+		failures: New(perMinute, burst),
+		duration: duration,
+		until:    make(map[string]time.Time),
+	}
+}
+
+// Locked reports whether key is locked out and for how much longer.
+func (l *Lockout) Locked(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.until[key]
+	if !ok {
+		return 0, false
+	}
+	if left := time.Until(until); left > 0 {
+		return left, true
+	}
+	delete(l.until, key)
+	return 0, false
+}
+
+// Fail records a failure for key and reports whether it locked the key out.
+func (l *Lockout) Fail(key string) bool {
+	if ok, _ := l.failures.Allow(key); ok {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, until := range l.until {
+		if now.After(until) {
+			delete(l.until, k)
+		}
+	}
+	l.until[key] = now.Add(l.duration)
+	return true
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	l := New(600, 2) // 10 per second
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst refused", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("request beyond the burst allowed")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("wait = %v, want up to 100ms", wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("another key was refused")
+	}
+
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("request refused after the bucket refilled")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("refill gave more than one token")
+	}
+}
+
+func TestLimiterRefillCappedAtBurst(t *testing.T) {
+	l := New(6000, 2) // 100 per second
+	l.Allow("a")
+	time.Sleep(50 * time.Millisecond) // Enough for 5 tokens
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("a"); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("%d requests allowed after idling, want the burst of 2", allowed)
+	}
+}
+
+func TestLimiterAllowIsAllOrNothing(t *testing.T) {
+	l := New(60, 1)
+	if ok, _ := l.Allow("ip", "token"); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := l.Allow("other-ip", "token"); ok {
+		t.Fatal("request allowed with an empty token bucket")
+	}
+	// The refused request must not have used other-ip's allowance
+	if ok, _ := l.Allow("other-ip", "other-token"); !ok {
+		t.Fatal("refused request consumed a token from another key")
+	}
+}
+
+func TestLockoutAfterBurstAndExpiry(t *testing.T) {
+	l := NewLockout(1, 3, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if l.Fail("a") {
+			t.Fatalf("failure %d within the burst locked the key", i)
+		}
+		if _, locked := l.Locked("a"); locked {
+			t.Fatalf("key locked after %d failures", i+1)
+		}
+	}
+	if !l.Fail("a") {
+		t.Fatal("failure beyond the burst did not lock the key")
+	}
+	left, locked := l.Locked("a")
+	if !locked || left <= 0 || left > 50*time.Millisecond {
+		t.Fatalf("Locked = %v, %v; want locked for up to 50ms", left, locked)
+	}
+	if _, locked := l.Locked("b"); locked {
+		t.Fatal("another key is locked")
+	}
+
+	time.Sleep(left + 10*time.Millisecond)
+	if _, locked := l.Locked("a"); locked {
+		t.Fatal("key still locked after the lockout expired")
+	}
+}
+
+func TestLockoutAllowanceRefills(t *testing.T) {
+	l := NewLockout(6000, 1, time.Minute) // 100 failures per second forgiven
+	for i := 0; i < 5; i++ {
+		if l.Fail("a") {
+			t.Fatalf("failure %d locked the key despite the refill", i)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	l.Fail("a")
+	if !l.Fail("a") {
+		t.Fatal("a burst of failures did not lock the key")
+	}
+}
@@ -0,0 +1,179 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"stackbill-deployer/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Definition describes one stage in the manifest.
+type Definition struct {
+	Role   string            `yaml:"role"`
+	Name   string            `yaml:"name"`
+	Header string            `yaml:"header"` // Log header text; defaults to Name
+	When   map[string]string `yaml:"when"`   // Deployment settings the stage depends on
+	Types  []string          `yaml:"types"`  // Deployment types the stage runs in; defaults to install only
+}
+
+// Manifest is the ordered stage list loaded from ansible/stages.yml.
+type Manifest struct {
+	Stages []Definition `yaml:"stages"`
+}
+
+// Load reads and validates the stage manifest at path.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stage manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse stage manifest: %w", err)
+	}
+	if len(m.Stages) == 0 {
+		return nil, fmt.Errorf("stage manifest %s defines no stages", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, def := range m.Stages {
+		if def.Role == "" || def.Name == "" {
+			return nil, fmt.Errorf("stage manifest entry %d must set role and name", i+1)
+		}
+		if seen[def.Role] {
+			return nil, fmt.Errorf("stage manifest lists role %q more than once", def.Role)
+		}
+		seen[def.Role] = true
+		for key := range def.When {
+			if _, ok := settings(models.DeployRequest{})[key]; !ok {
+				return nil, fmt.Errorf("stage %q has unknown condition %q", def.Role, key)
+			}
+		}
+		for _, t := range def.Types {
+			if t != models.DeployTypeInstall && t != models.DeployTypeUpgrade && t != models.DeployTypeUninstall {
+				return nil, fmt.Errorf("stage %q has unknown deployment type %q", def.Role, t)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// Build returns the ordered, pending stages that apply to req.
+func (m *Manifest) Build(req models.DeployRequest) []models.Stage {
+	values := settings(req)
+	deployType := req.Type
+	if deployType == "" {
+		deployType = models.DeployTypeInstall
+	}
+	var stages []models.Stage
+	for _, def := range m.Stages {
+		if !def.runsFor(deployType) || !def.matches(values) {
+			continue
+		}
+		stages = append(stages, models.Stage{Name: def.Name, Role: def.Role, Status: "pending"})
+	}
+	return stages
+}
+
+// CheckPlaybook verifies that the playbook runs exactly the roles of the
+// manifest stages for the given deployment types, in order.
+func (m *Manifest) CheckPlaybook(path string, deployTypes ...string) error {
+	roles, err := playbookRoles(path)
+	if err != nil {
+		return err
+	}
+
+	var want []string
+	for _, def := range m.Stages {
+		for _, t := range deployTypes {
+			if def.runsFor(t) {
+				want = append(want, def.Role)
+				break
+			}
+		}
+	}
+	if strings.Join(roles, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("playbook roles do not match stage manifest:\n  playbook: %s\n  manifest: %s",
+			strings.Join(roles, ", "), strings.Join(want, ", "))
+	}
+	return nil
+}
+
+func (d Definition) runsFor(deployType string) bool {
+	if len(d.Types) == 0 {
+		return deployType == models.DeployTypeInstall
+	}
+	for _, t := range d.Types {
+		if t == deployType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Definition) matches(values map[string]string) bool {
+	for key, want := range d.When {
+		if values[key] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// settings exposes the deployment settings that manifest conditions may refer to.
+func settings(req models.DeployRequest) map[string]string {
+	cluster := "single"
+	if len(req.Nodes) > 0 {
+		cluster = "multi"
+	}
+	return map[string]string{
+		"ssl_mode":         req.SSLMode,
+		"cloudstack_mode":  req.CloudStackMode,
+		"cluster":          cluster,
+		"delete_pvc":       strconv.FormatBool(req.Uninstall.DeletePVC),
+		"delete_namespace": strconv.FormatBool(req.Uninstall.DeleteNamespace),
+		"delete_databases": strconv.FormatBool(req.Uninstall.DeleteDatabases),
+		"remove_simulator": strconv.FormatBool(req.Uninstall.RemoveSimulator),
+	}
+}
+
+// playbookRoles returns the role names listed in the playbook's plays, in order.
+// Entries may be plain names or maps with a "role" key.
+func playbookRoles(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playbook: %w", err)
+	}
+
+	var plays []struct {
+		Roles []yaml.Node `yaml:"roles"`
+	}
+	if err := yaml.Unmarshal(data, &plays); err != nil {
+		return nil, fmt.Errorf("failed to parse playbook: %w", err)
+	}
+
+	var roles []string
+	for _, play := range plays {
+		for _, node := range play.Roles {
+			var name string
+			if node.Kind == yaml.ScalarNode {
+				name = node.Value
+			} else {
+				var entry struct {
+					Role string `yaml:"role"`
+				}
+				if err := node.Decode(&entry); err != nil {
+					return nil, fmt.Errorf("failed to parse playbook role entry: %w", err)
+				}
+				name = entry.Role
+			}
+			roles = append(roles, name)
+		}
+	}
+	return roles, nil
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"stackbill-deployer/internal/models"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout:
+//
+//	deployments/<id> -> deployment metadata (JSON, without stages)
+//	stages/<id>      -> stage list (JSON)
+var (
+	deploymentsBucket = []byte("deployments")
+	stagesBucket      = []byte("stages")
+)
+
+// BoltStore is a Store backed by a single bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens (or creates) the bbolt database at path.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{deploymentsBucket, stagesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Save(dep *models.Deployment) error {
+	meta := *dep
+	meta.Stages = nil
+	meta.Logs = nil
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	stagesJSON, err := json.Marshal(dep.Stages)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		id := []byte(dep.ID)
+		if err := tx.Bucket(deploymentsBucket).Put(id, metaJSON); err != nil {
+			return err
+		}
+		return tx.Bucket(stagesBucket).Put(id, stagesJSON)
+	})
+}
+
+func (s *BoltStore) Load() ([]*models.Deployment, error) {
+	var deps []*models.Deployment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stages := tx.Bucket(stagesBucket)
+		return tx.Bucket(deploymentsBucket).ForEach(func(k, v []byte) error {
+			var dep models.Deployment
+			if err := json.Unmarshal(v, &dep); err != nil {
+				return fmt.Errorf("corrupt deployment record %s: %w", k, err)
+			}
+			if raw := stages.Get(k); raw != nil {
+				if err := json.Unmarshal(raw, &dep.Stages); err != nil {
+					return fmt.Errorf("corrupt stage record %s: %w", k, err)
+				}
+			}
+			deps = append(deps, &dep)
+			return nil
+		})
+	})
+	return deps, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"stackbill-deployer/internal/logstore"
+	"stackbill-deployer/internal/models"
+)
+
+// Store persists deployments and their stages as separate records.
+// Log lines live in the logstore package.
+type Store interface {
+	// Save writes the deployment's metadata and stages in one transaction.
+	Save(dep *models.Deployment) error
+	// Load returns all deployments with their stages.
+	Load() ([]*models.Deployment, error)
+	Close() error
+}
+
+// MigrateStateFile imports a legacy state.json into st and logs, and renames
+// it so the import only happens once. A missing state file is not an error.
+func MigrateStateFile(st Store, logs *logstore.Store, path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var deps map[string]*models.Deployment
+	if err := json.Unmarshal(data, &deps); err != nil {
+		return fmt.Errorf("failed to parse state file: %w", err)
+	}
+
+	for _, dep := range deps {
+		count, err := logs.Append(dep.ID, dep.Logs...)
+		if err != nil {
+			return fmt.Errorf("failed to migrate logs of %s: %w", dep.ID, err)
+		}
+		logs.Finish(dep.ID)
+		dep.LogCount = count
+		dep.Logs = nil
+		if err := st.Save(dep); err != nil {
+			return fmt.Errorf("failed to migrate deployment %s: %w", dep.ID, err)
+		}
+	}
+
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return fmt.Errorf("failed to rename migrated state file: %w", err)
+	}
+	log.Printf("Migrated %d deployment(s) from %s", len(deps), path)
+	return nil
+}
@@ -102,20 +102,14 @@ $RUNTIME run -d --name "$CONTAINER_NAME" \
 sleep 2
 
 TOKEN=""
-# Try reading from persistent data volume first
-TOKEN=$($RUNTIME exec "$CONTAINER_NAME" cat /app/data/token 2>/dev/null | tr -d '[:space:]')
-
-# Fallback: parse from container logs
-if [ -z "$TOKEN" ]; then
-    for i in $(seq 1 10); do
-        LOGS=$($RUNTIME logs "$CONTAINER_NAME" 2>&1)
-        TOKEN=$(echo "$LOGS" | grep "Auth Token:" | awk '{print $NF}' | tail -1)
-        if [ -n "$TOKEN" ]; then
-            break
-        fi
-        sleep 1
-    done
-fi
+# The admin token is only stored in the persistent data volume (never logged)
+for i in $(seq 1 10); do
+    TOKEN=$($RUNTIME exec "$CONTAINER_NAME" cat /app/data/token 2>/dev/null | tr -d '[:space:]')
+    if [ -n "$TOKEN" ]; then
+        break
+    fi
+    sleep 1
+done
 
 if [ -z "$TOKEN" ]; then
     error "Could not extract auth token. Check container logs:"
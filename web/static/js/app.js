@@ -16,7 +16,24 @@ document.addEventListener('DOMContentLoaded', function() {
     var authTokenInput = document.getElementById('auth_token');
     var authBtn = document.getElementById('auth-btn');
     var authError = document.getElementById('auth-error');
-    var authToken = sessionStorage.getItem('sb_auth_token') || '';
+    var logoutBtn = document.getElementById('logout-btn');
+    // The session cookie is HttpOnly; only the CSRF token is visible to scripts
+    var csrfToken = '';
+
+    // Deployment type toggle: upgrades only need the server, domain and chart version
+    var deployTypeRadios = document.querySelectorAll('input[name="deploy_type"]');
+    var upgradeOptions = document.getElementById('upgrade-options');
+
+    deployTypeRadios.forEach(function(radio) {
+        radio.addEventListener('change', function() {
+            var upgrade = this.value === 'upgrade';
+            upgradeOptions.classList.toggle('hidden', !upgrade);
+            document.querySelectorAll('.install-only').forEach(function(section) {
+                section.classList.toggle('hidden', upgrade);
+            });
+            validateForm();
+        });
+    });
 
     // SSL mode toggle (segmented control)
     var sslRadios = document.querySelectorAll('input[name="ssl_mode"]');
@@ -43,6 +60,14 @@ document.addEventListener('DOMContentLoaded', function() {
     var sslKeyInput = document.getElementById('ssl_key');
     var sslCertContent = '';
     var sslKeyContent = '';
+    var sshKeyInput = document.getElementById('ssh_key');
+    var sshKeyContent = '';
+
+    var fileUploadPlaceholders = {
+        ssl_cert_name: 'Choose certificate file',
+        ssl_key_name: 'Choose private key file',
+        ssh_key_name: 'Choose SSH private key'
+    };
 
     function setupFileUpload(input, nameId) {
         input.addEventListener('change', function() {
@@ -55,6 +80,8 @@ document.addEventListener('DOMContentLoaded', function() {
                 reader.onload = function(e) {
                     if (nameId === 'ssl_cert_name') {
                         sslCertContent = e.target.result;
+                    } else if (nameId === 'ssh_key_name') {
+                        sshKeyContent = e.target.result;
                     } else {
                         sslKeyContent = e.target.result;
                     }
@@ -62,9 +89,10 @@ document.addEventListener('DOMContentLoaded', function() {
                 };
                 reader.readAsText(input.files[0]);
             } else {
-                nameEl.textContent = nameId === 'ssl_cert_name' ? 'Choose certificate file' : 'Choose private key file';
+                nameEl.textContent = fileUploadPlaceholders[nameId];
                 label.classList.remove('has-file');
                 if (nameId === 'ssl_cert_name') sslCertContent = '';
+                else if (nameId === 'ssh_key_name') sshKeyContent = '';
                 else sslKeyContent = '';
                 validateForm();
             }
@@ -73,6 +101,24 @@ document.addEventListener('DOMContentLoaded', function() {
 
     setupFileUpload(sslCertInput, 'ssl_cert_name');
     setupFileUpload(sslKeyInput, 'ssl_key_name');
+    setupFileUpload(sshKeyInput, 'ssh_key_name');
+
+    // SSH auth toggle (password vs private key)
+    var sshAuthRadios = document.querySelectorAll('input[name="ssh_auth"]');
+    var sshKeyOptions = document.getElementById('ssh-key-options');
+    var sshPassLabel = document.getElementById('ssh_pass_label');
+
+    sshAuthRadios.forEach(function(radio) {
+        radio.addEventListener('change', function() {
+            if (this.value === 'key') {
+                sshKeyOptions.classList.remove('hidden');
+                sshPassLabel.textContent = 'Sudo Password (optional)';
+            } else {
+                sshKeyOptions.classList.add('hidden');
+                sshPassLabel.textContent = 'SSH Password';
+            }
+        });
+    });
 
     // CloudStack mode toggle (segmented control)
     var csRadios = document.querySelectorAll('input[name="cloudstack_mode"]');
@@ -112,9 +158,9 @@ document.addEventListener('DOMContentLoaded', function() {
     function checkAndResume(deployments) {
         var active = null;
         if (deployments && deployments.length) {
-            // Priority 1: running/pending deployment
+            // Priority 1: running/pending/queued deployment
             for (var i = 0; i < deployments.length; i++) {
-                if (deployments[i].status === 'running' || deployments[i].status === 'pending') {
+                if (deployments[i].status === 'running' || deployments[i].status === 'pending' || deployments[i].status === 'queued') {
                     active = deployments[i];
                     break;
                 }
@@ -142,20 +188,34 @@ document.addEventListener('DOMContentLoaded', function() {
         authBtn.textContent = 'Verifying...';
         authError.style.display = 'none';
 
-        fetch('/api/deployments', {
-            headers: { 'Authorization': 'Bearer ' + token }
+        // Exchange the token for a session cookie; the token itself is not kept
+        fetch('/api/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token: token })
         }).then(function(r) {
             if (r.ok) {
-                authToken = token;
-                sessionStorage.setItem('sb_auth_token', token);
-                authSection.classList.add('hidden');
-                return r.json().then(function(deployments) {
-                    checkAndResume(deployments);
+                authTokenInput.value = '';
+                return r.json().then(function(session) {
+                    csrfToken = session.csrf_token;
+                    authSection.classList.add('hidden');
+                    authBtn.disabled = false;
+                    authBtn.textContent = 'Continue';
+                    logoutBtn.classList.remove('hidden');
+                    return loadDeployments();
+                });
+            }
+            if (r.status === 429) {
+                // Locked out after too many invalid tokens; the message says for how long
+                return r.json().then(function(data) {
+                    authError.textContent = data.error;
+                    authError.style.display = '';
+                    authBtn.disabled = false;
+                    authBtn.textContent = 'Continue';
                 });
-            } else {
-                authError.textContent = 'Invalid access token.';
-                authError.style.display = '';
             }
+            authError.textContent = 'Invalid access token.';
+            authError.style.display = '';
             authBtn.disabled = false;
             authBtn.textContent = 'Continue';
         }).catch(function() {
@@ -166,30 +226,52 @@ document.addEventListener('DOMContentLoaded', function() {
         });
     }
 
-    // Auto-verify saved token on page load + resume active deployment
-    if (authToken) {
-        authSection.style.opacity = '0.5';
-        fetch('/api/deployments', {
-            headers: { 'Authorization': 'Bearer ' + authToken }
-        }).then(function(r) {
-            authSection.style.opacity = '';
-            if (r.ok) {
-                return r.json().then(function(deployments) {
-                    authSection.classList.add('hidden');
-                    checkAndResume(deployments);
-                });
-            } else {
-                sessionStorage.removeItem('sb_auth_token');
-                authToken = '';
+    function loadDeployments() {
+        return fetch('/api/deployments').then(function(r) {
+            if (r.status === 401) {
+                handleAuthFailure();
+                return;
             }
-        }).catch(function() {
-            authSection.style.opacity = '';
+            return r.json().then(checkAndResume);
         });
     }
 
+    // A failed SSO login comes back with the reason in the URL
+    var loginError = new URLSearchParams(window.location.search).get('login_error');
+    if (loginError) {
+        authError.textContent = loginError;
+        authError.style.display = '';
+        history.replaceState(null, '', '/');
+    }
+
+    // Pick up an existing session on page load + resume active deployment
+    authSection.style.opacity = '0.5';
+    fetch('/api/session').then(function(r) {
+        authSection.style.opacity = '';
+        if (!r.ok) return;
+        return r.json().then(function(session) {
+            csrfToken = session.csrf_token;
+            authSection.classList.add('hidden');
+            logoutBtn.classList.remove('hidden');
+            return loadDeployments();
+        });
+    }).catch(function() {
+        authSection.style.opacity = '';
+    });
+
+    logoutBtn.addEventListener('click', function() {
+        fetch('/api/logout', {
+            method: 'POST',
+            headers: { 'X-CSRF-Token': csrfToken }
+        }).finally(function() {
+            handleAuthFailure();
+            authError.style.display = 'none';
+        });
+    });
+
     function handleAuthFailure() {
-        sessionStorage.removeItem('sb_auth_token');
-        authToken = '';
+        csrfToken = '';
+        logoutBtn.classList.add('hidden');
         dashboardSection.classList.add('hidden');
         formSection.classList.add('hidden');
         authSection.classList.remove('hidden');
@@ -212,12 +294,21 @@ document.addEventListener('DOMContentLoaded', function() {
             if (input.closest('.hidden')) return;
             if (!input.value.trim()) allFilled = false;
         });
-        // Check file uploads when custom SSL is selected
+        // Check file uploads when custom SSL is selected (not used by upgrades)
         var sslMode = document.querySelector('input[name="ssl_mode"]:checked').value;
-        if (sslMode === 'custom') {
+        var deployType = document.querySelector('input[name="deploy_type"]:checked').value;
+        if (sslMode === 'custom' && deployType === 'install') {
             if (!sslCertContent || !sslKeyContent) allFilled = false;
         }
-        deployBtn.disabled = !allFilled;
+        // Password auth needs a password; key auth needs an uploaded key
+        var sshAuth = document.querySelector('input[name="ssh_auth"]:checked').value;
+        if (sshAuth === 'key') {
+            if (!sshKeyContent) allFilled = false;
+        } else if (!document.getElementById('ssh_pass').value.trim()) {
+            allFilled = false;
+        }
+        preflightBtn.disabled = !allFilled || preflightRunning;
+        deployBtn.disabled = !allFilled || !preflightPassed;
     }
 
     requiredFields.forEach(function(input) {
@@ -231,22 +322,144 @@ document.addEventListener('DOMContentLoaded', function() {
     csRadios.forEach(function(radio) {
         radio.addEventListener('change', validateForm);
     });
+    sshAuthRadios.forEach(function(radio) {
+        radio.addEventListener('change', validateForm);
+    });
+    document.getElementById('ssh_pass').addEventListener('input', validateForm);
 
     // ==========================================
-    // FORM SUBMISSION
+    // PRE-FLIGHT CHECKS
     // ==========================================
 
-    form.addEventListener('submit', async function(e) {
-        e.preventDefault();
+    // Deploy stays disabled until pre-flight checks pass (warnings allowed)
+    // for the current form values; any edit requires a new run.
+    var preflightBtn = document.getElementById('preflight-btn');
+    var preflightReport = document.getElementById('preflight-report');
+    var preflightPassed = false;
+    var preflightRunning = false;
+
+    function invalidatePreflight() {
+        if (preflightRunning) return;
+        if (preflightPassed || !preflightReport.classList.contains('hidden')) {
+            preflightPassed = false;
+            preflightReport.classList.add('preflight-stale');
+        }
+        validateForm();
+    }
+
+    form.addEventListener('input', invalidatePreflight);
+    form.addEventListener('change', invalidatePreflight);
+
+    function renderPreflight(report) {
+        var html = '<div class="preflight-summary preflight-' + escapeHtml(report.status) + '">' +
+            (report.status === 'fail' ? 'Pre-flight checks failed — fix the items below before deploying.' :
+             report.status === 'warn' ? 'Pre-flight checks passed with warnings.' : 'All pre-flight checks passed.') +
+            '</div><ul class="preflight-list">';
+        report.checks.forEach(function(check) {
+            html += '<li class="preflight-item preflight-' + escapeHtml(check.status) + '">' +
+                '<span class="preflight-status">' + escapeHtml(check.status) + '</span>' +
+                '<span class="preflight-name">' + (check.host ? escapeHtml(check.host) + ': ' : '') + escapeHtml(check.name) + '</span>' +
+                '<span class="preflight-message">' + escapeHtml(check.message) + '</span>' +
+                '</li>';
+        });
+        html += '</ul>';
+        preflightReport.innerHTML = html;
+        preflightReport.classList.remove('hidden', 'preflight-stale');
+    }
+
+    preflightBtn.addEventListener('click', async function() {
+        preflightRunning = true;
+        preflightPassed = false;
+        validateForm();
+        preflightBtn.innerHTML = '<span class="btn-deploying"><span class="spinner"></span> Checking...</span>';
+
+        try {
+            var response = await postDeployRequest('/api/preflight', buildPayload());
+
+            if (response.status === 401) {
+                handleAuthFailure();
+                return;
+            }
+            var data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error || 'Pre-flight checks failed to run');
+            }
+            renderPreflight(data);
+            preflightPassed = data.status !== 'fail';
+        } catch (err) {
+            alert('Pre-flight error: ' + err.message);
+        } finally {
+            preflightRunning = false;
+            preflightBtn.textContent = 'Run Pre-flight Checks';
+            validateForm();
+        }
+    });
+
+    // ==========================================
+    // CLUSTER NODES
+    // ==========================================
+
+    var nodeRows = document.getElementById('node-rows');
+    var nodeRowSeq = 0;
+
+    function addNodeRow() {
+        var n = ++nodeRowSeq;
+        var row = document.createElement('div');
+        row.className = 'node-row';
+        row.innerHTML =
+            '<div class="form-group">' +
+                '<input type="text" id="node_host_' + n + '" class="node-host" placeholder="Node IP">' +
+                '<label for="node_host_' + n + '">Node IP Address</label>' +
+            '</div>' +
+            '<div class="segmented-control">' +
+                '<input type="radio" id="node_role_server_' + n + '" name="node_role_' + n + '" value="server">' +
+                '<label for="node_role_server_' + n + '" class="seg-option">Server</label>' +
+                '<input type="radio" id="node_role_agent_' + n + '" name="node_role_' + n + '" value="agent" checked>' +
+                '<label for="node_role_agent_' + n + '" class="seg-option">Agent</label>' +
+            '</div>' +
+            '<button type="button" class="node-remove" title="Remove node">&times;</button>';
+        row.querySelector('.node-remove').addEventListener('click', function() {
+            row.remove();
+        });
+        nodeRows.appendChild(row);
+    }
 
+    function collectNodes() {
+        var nodes = [];
+        nodeRows.querySelectorAll('.node-row').forEach(function(row) {
+            var host = row.querySelector('.node-host').value.trim();
+            if (!host) return;
+            nodes.push({ host: host, role: row.querySelector('input[type="radio"]:checked').value });
+        });
+        return nodes;
+    }
+
+    document.getElementById('add-node-btn').addEventListener('click', addNodeRow);
+
+    // ==========================================
+    // FORM SUBMISSION
+    // ==========================================
+
+    function buildPayload() {
         var sslMode = document.querySelector('input[name="ssl_mode"]:checked').value;
         var cloudstackMode = document.querySelector('input[name="cloudstack_mode"]:checked').value;
+        var sshAuth = document.querySelector('input[name="ssh_auth"]:checked').value;
+        var deployType = document.querySelector('input[name="deploy_type"]:checked').value;
 
-        var payload = {
+        return {
+            type: deployType,
+            chart_version: deployType === 'upgrade' ? document.getElementById('chart_version').value.trim() : '',
             server_ip: document.getElementById('server_ip').value,
             ssh_user: document.getElementById('ssh_user').value,
             ssh_pass: document.getElementById('ssh_pass').value,
             ssh_port: parseInt(document.getElementById('ssh_port').value) || 22,
+            ssh_key: sshAuth === 'key' ? sshKeyContent : '',
+            ssh_key_passphrase: sshAuth === 'key' ? document.getElementById('ssh_key_passphrase').value : '',
+            jump_host: document.getElementById('jump_host').value.trim(),
+            jump_port: parseInt(document.getElementById('jump_port').value) || 0,
+            jump_user: document.getElementById('jump_user').value.trim(),
+            jump_pass: document.getElementById('jump_pass').value,
+            nodes: deployType === 'upgrade' ? [] : collectNodes(),
             domain: document.getElementById('domain').value,
             ssl_mode: sslMode,
             letsencrypt_email: document.getElementById('letsencrypt_email').value,
@@ -256,20 +469,47 @@ document.addEventListener('DOMContentLoaded', function() {
             cloudstack_version: document.getElementById('cloudstack_version').value,
             ecr_token: document.getElementById('ecr_token').value
         };
+    }
 
-        lastPayload = payload;
-        deployBtn.disabled = true;
-        deployBtn.innerHTML = '<span class="btn-deploying"><span class="spinner"></span> Deploying...</span>';
-
-        try {
-            var response = await fetch('/api/deploy', {
+    // POST a deploy request. Servers the deployer has never connected to are
+    // answered with 409 and their host key fingerprints; once the user confirms
+    // them, the request is sent again with the fingerprints attached.
+    async function postDeployRequest(url, payload) {
+        while (true) {
+            var response = await fetch(url, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
-                    'Authorization': 'Bearer ' + authToken
+                    'X-CSRF-Token': csrfToken
                 },
                 body: JSON.stringify(payload)
             });
+            if (response.status !== 409) return response;
+
+            var data = await response.clone().json();
+            if (data.code !== 'host_key_unconfirmed') return response;
+
+            var lines = Object.keys(data.host_keys).map(function(addr) {
+                return addr + '\n    ' + data.host_keys[addr];
+            });
+            if (!confirm('First connection to the following server(s). Verify the host key fingerprints ' +
+                    'before trusting them:\n\n' + lines.join('\n') + '\n\nTrust these host keys?')) {
+                throw new Error('Host keys were not confirmed');
+            }
+            payload.host_keys = Object.assign({}, payload.host_keys, data.host_keys);
+        }
+    }
+
+    form.addEventListener('submit', async function(e) {
+        e.preventDefault();
+
+        var payload = buildPayload();
+
+        deployBtn.disabled = true;
+        deployBtn.innerHTML = '<span class="btn-deploying"><span class="spinner"></span> Deploying...</span>';
+
+        try {
+            var response = await postDeployRequest('/api/deploy', payload);
 
             if (!response.ok) {
                 if (response.status === 401) {
@@ -293,30 +533,38 @@ document.addEventListener('DOMContentLoaded', function() {
     var currentServerIP = '';
     var currentDeploymentId = '';
     var currentCloudStackMode = '';
-    var lastPayload = null;
+    var currentDeployType = '';
     var rawLogLines = [];
     var retryBtn = document.getElementById('retry-btn');
+    var cancelBtn = document.getElementById('cancel-btn');
+    var uninstallBtn = document.getElementById('uninstall-btn');
+    var uninstallPanel = document.getElementById('uninstall-panel');
 
     function showDashboard(deploymentId, stages) {
         currentDomain = document.getElementById('domain').value;
         currentServerIP = document.getElementById('server_ip').value;
         currentDeploymentId = deploymentId;
         currentCloudStackMode = document.querySelector('input[name="cloudstack_mode"]:checked').value;
+        currentDeployType = document.querySelector('input[name="deploy_type"]:checked').value;
         formSection.classList.add('hidden');
         dashboardSection.classList.remove('hidden');
         appContainer.classList.add('container-wide');
         logOutput.innerHTML = '';
         rawLogLines = [];
-        statusBadge.className = 'badge badge-running';
-        statusBadge.textContent = 'Running';
+        // New deployments start in the queue; the stream reports when they run
+        updateRunStatus('queued', 0);
         newDeployBtn.classList.add('hidden');
         retryBtn.classList.add('hidden');
+        uninstallBtn.classList.add('hidden');
+        uninstallPanel.classList.add('hidden');
+        cancelBtn.classList.remove('hidden');
         if (liveDot) liveDot.style.display = '';
         // Clear any previous result
         var oldResult = document.getElementById('result-panel');
         if (oldResult) oldResult.remove();
 
         renderStages(stages);
+        renderNodes(null);
         connectSSE(deploymentId);
     }
 
@@ -326,7 +574,7 @@ document.addEventListener('DOMContentLoaded', function() {
         currentServerIP = (deployment.config && deployment.config.server_ip) || '';
         currentDeploymentId = deployment.id;
         currentCloudStackMode = (deployment.config && deployment.config.cloudstack_mode) || '';
-        lastPayload = null; // No retry on resumed sessions (no secrets available)
+        currentDeployType = (deployment.config && deployment.config.type) || '';
         formSection.classList.add('hidden');
         dashboardSection.classList.remove('hidden');
         appContainer.classList.add('container-wide');
@@ -336,13 +584,15 @@ document.addEventListener('DOMContentLoaded', function() {
         if (oldResult) oldResult.remove();
 
         renderStages(deployment.stages);
+        renderNodes(deployment.nodes);
 
         // For active deployments: show running state and connect SSE
-        if (deployment.status === 'running' || deployment.status === 'pending') {
-            statusBadge.className = 'badge badge-running';
-            statusBadge.textContent = 'Running';
+        if (deployment.status === 'running' || deployment.status === 'pending' || deployment.status === 'queued') {
+            updateRunStatus(deployment.status, deployment.queue_position);
             newDeployBtn.classList.add('hidden');
             retryBtn.classList.add('hidden');
+            uninstallBtn.classList.add('hidden');
+            cancelBtn.classList.remove('hidden');
             if (liveDot) liveDot.style.display = '';
             connectSSE(deployment.id);
         } else {
@@ -350,6 +600,7 @@ document.addEventListener('DOMContentLoaded', function() {
             if (liveDot) liveDot.style.display = 'none';
             newDeployBtn.classList.remove('hidden');
             retryBtn.classList.add('hidden');
+            cancelBtn.classList.add('hidden');
             // Connect SSE to get catch-up logs, then it will send done event
             connectSSE(deployment.id);
         }
@@ -391,11 +642,48 @@ document.addEventListener('DOMContentLoaded', function() {
         stageCounter.textContent = '0 / ' + stages.length;
     }
 
+    // Per-node progress for multi-node clusters
+    var nodePanel = document.getElementById('node-panel');
+    var nodeStatusList = document.getElementById('node-status-list');
+
+    function renderNodes(nodes) {
+        nodeStatusList.innerHTML = '';
+        if (!nodes || !nodes.length) {
+            nodePanel.classList.add('hidden');
+            return;
+        }
+        nodePanel.classList.remove('hidden');
+        for (var i = 0; i < nodes.length; i++) {
+            var node = nodes[i];
+            var div = document.createElement('div');
+            div.className = 'node-item stage-' + node.status;
+
+            var indicator = document.createElement('div');
+            indicator.className = 'stage-indicator';
+            indicator.innerHTML = getIndicatorContent(node.status);
+
+            var text = document.createElement('div');
+            text.className = 'node-text';
+            var host = document.createElement('span');
+            host.className = 'stage-name';
+            host.textContent = node.host + ' (' + node.role + (node.primary ? ', primary' : '') + ')';
+            var stage = document.createElement('small');
+            stage.className = 'node-stage';
+            stage.textContent = node.stage || 'Waiting';
+            text.appendChild(host);
+            text.appendChild(stage);
+
+            div.appendChild(indicator);
+            div.appendChild(text);
+            nodeStatusList.appendChild(div);
+        }
+    }
+
     function getIndicatorContent(status) {
         if (status === 'done') return checkSVG;
         if (status === 'running') return dotSVG;
         if (status === 'error') return crossSVG;
-        if (status === 'interrupted') return warnSVG;
+        if (status === 'interrupted' || status === 'cancelled') return warnSVG;
         return '';
     }
 
@@ -441,13 +729,18 @@ document.addEventListener('DOMContentLoaded', function() {
     // --- SSE connection (with auth token as query param) ---
 
     function connectSSE(deploymentId) {
-        var evtSource = new EventSource('/api/deployments/' + deploymentId + '/stream?token=' + encodeURIComponent(authToken));
+        var evtSource = new EventSource('/api/deployments/' + deploymentId + '/stream');
 
         evtSource.addEventListener('stages', function(e) {
             var stages = JSON.parse(e.data);
             updateAllStages(stages);
         });
 
+        evtSource.addEventListener('status', function(e) {
+            var data = JSON.parse(e.data);
+            updateRunStatus(data.status, data.queue_position);
+        });
+
         evtSource.addEventListener('log', function(e) {
             rawLogLines.push(e.data);
             appendLog(e.data);
@@ -458,6 +751,10 @@ document.addEventListener('DOMContentLoaded', function() {
             updateStage(data);
         });
 
+        evtSource.addEventListener('nodes', function(e) {
+            renderNodes(JSON.parse(e.data));
+        });
+
         evtSource.addEventListener('done', function(e) {
             var data = JSON.parse(e.data);
             updateFinalStatus(data.status);
@@ -467,15 +764,30 @@ document.addEventListener('DOMContentLoaded', function() {
             evtSource.close();
         });
 
+        // The browser reconnects on its own and resumes from the last event id;
+        // fall back to polling only once it gives up
         evtSource.onerror = function() {
-            evtSource.close();
-            pollStatus(deploymentId);
+            if (evtSource.readyState === EventSource.CLOSED) {
+                pollStatus(deploymentId);
+            }
         };
     }
 
+    // Badge for a deployment that is still waiting or running
+    function updateRunStatus(status, queuePosition) {
+        if (status === 'queued') {
+            statusBadge.className = 'badge badge-queued';
+            statusBadge.textContent = queuePosition ? 'Queued #' + queuePosition : 'Queued';
+        } else {
+            statusBadge.className = 'badge badge-running';
+            statusBadge.textContent = 'Running';
+        }
+    }
+
     function updateFinalStatus(status) {
         // Hide live dot
         if (liveDot) liveDot.style.display = 'none';
+        cancelBtn.classList.add('hidden');
 
         if (status === 'success') {
             statusBadge.className = 'badge badge-success';
@@ -487,39 +799,32 @@ document.addEventListener('DOMContentLoaded', function() {
             statusBadge.textContent = 'Interrupted';
             showResultPanel('interrupted');
             retryBtn.classList.add('hidden');
+        } else if (status === 'cancelled') {
+            statusBadge.className = 'badge badge-cancelled';
+            statusBadge.textContent = 'Cancelled';
+            showResultPanel('cancelled');
+            retryBtn.classList.remove('hidden');
         } else if (status === 'failed') {
             statusBadge.className = 'badge badge-failed';
             statusBadge.textContent = 'Failed';
             showResultPanel('failed');
-            if (lastPayload) retryBtn.classList.remove('hidden');
+            retryBtn.classList.remove('hidden');
         }
+        // An uninstall cannot be uninstalled again, but it can be retried
+        uninstallBtn.classList.toggle('hidden', currentDeployType === 'uninstall');
         newDeployBtn.classList.remove('hidden');
     }
 
-    // Parse deployment info from raw log lines
+    // Parse the NodePorts from raw log lines. Credentials are masked in the
+    // log and come from the credentials API instead.
     function parseDeployInfo() {
-        var info = { httpPort: '', httpsPort: '', csURL: '', csUser: '', csPass: '', csAPIKey: '', csSecretKey: '' };
+        var info = { httpPort: '', httpsPort: '' };
         for (var i = 0; i < rawLogLines.length; i++) {
             var line = rawLogLines[i];
             var httpMatch = line.match(/External Port 80\s+->\s+Internal\s+\S+:(\d+)/);
             if (httpMatch) info.httpPort = httpMatch[1];
             var httpsMatch = line.match(/External Port 443\s+->\s+Internal\s+\S+:(\d+)/);
             if (httpsMatch) info.httpsPort = httpsMatch[1];
-            var csURLMatch = line.match(/URL:\s+(http:\/\/\S+:8080\S*)/);
-            if (csURLMatch) info.csURL = csURLMatch[1];
-            if (line.match(/STACKBILL CLOUDSTACK USER/)) {
-                // Next few lines have Username, Password, API Key, Secret Key
-                for (var j = i + 1; j < Math.min(i + 6, rawLogLines.length); j++) {
-                    var uMatch = rawLogLines[j].match(/Username:\s+(\S+)/);
-                    if (uMatch) info.csUser = uMatch[1];
-                    var pMatch = rawLogLines[j].match(/Password:\s+(\S+)/);
-                    if (pMatch) info.csPass = pMatch[1];
-                    var akMatch = rawLogLines[j].match(/API Key:\s+(\S+)/);
-                    if (akMatch) info.csAPIKey = akMatch[1];
-                    var skMatch = rawLogLines[j].match(/Secret Key:\s+(\S+)/);
-                    if (skMatch) info.csSecretKey = skMatch[1];
-                }
-            }
         }
         return info;
     }
@@ -549,9 +854,22 @@ document.addEventListener('DOMContentLoaded', function() {
         var safeDomain = escapeHtml(currentDomain);
         var safeIP = escapeHtml(currentServerIP);
         var safeId = escapeHtml(currentDeploymentId);
-        var logDownloadURL = '/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/log?token=' + encodeURIComponent(authToken);
+        var logDownloadURL = '/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/log';
 
-        if (status === 'success') {
+        if (status === 'success' && currentDeployType === 'uninstall') {
+            panel.innerHTML =
+                '<h3>' + checkSVGDark + ' Uninstall Complete</h3>' +
+                '<div class="result-grid">' +
+                    '<div class="result-row">' +
+                        '<span class="result-label">Server</span>' +
+                        '<span class="result-value">' + safeIP + '</span>' +
+                    '</div>' +
+                    '<div class="result-row">' +
+                        '<span class="result-label">Uninstall Log</span>' +
+                        '<a href="' + escapeHtml(logDownloadURL) + '" class="result-download" download>Download Full Log</a>' +
+                    '</div>' +
+                '</div>';
+        } else if (status === 'success') {
             var portalURL = 'https://' + safeDomain + '/admin';
             var deployInfo = parseDeployInfo();
             var isSimulator = currentCloudStackMode === 'simulator';
@@ -601,31 +919,15 @@ document.addEventListener('DOMContentLoaded', function() {
                             '<span class="result-label">API Endpoint</span>' +
                             '<code class="result-path">' + csAPIURL + '</code>' +
                             makeCopyBtn(csAPIURLRaw) +
-                        '</div>';
-                if (deployInfo.csUser) {
-                    html += '<div class="result-row">' +
-                                '<span class="result-label">Username</span>' +
-                                '<span class="result-value">' + escapeHtml(deployInfo.csUser) + '</span>' +
-                                makeCopyBtn(deployInfo.csUser) +
-                            '</div>' +
-                            '<div class="result-row">' +
-                                '<span class="result-label">Password</span>' +
-                                makeSecretField(deployInfo.csPass) +
-                            '</div>';
-                }
-                if (deployInfo.csAPIKey) {
-                    html += '<div class="result-row">' +
-                            '<span class="result-label">API Key</span>' +
-                            makeSecretField(deployInfo.csAPIKey, true) +
                         '</div>' +
-                        '<div class="result-row">' +
-                            '<span class="result-label">Secret Key</span>' +
-                            makeSecretField(deployInfo.csSecretKey, true) +
-                        '</div>';
-                }
-                html += '</div></div>';
+                    '</div></div>';
             }
 
+            html += '<div class="result-section" id="credentials-section">' +
+                '<h4>Generated Credentials</h4>' +
+                '<button class="btn-secondary" onclick="revealCredentials()">Show Credentials</button>' +
+                '</div>';
+
             // Firewall / NAT rules section
             if (deployInfo.httpPort || deployInfo.httpsPort) {
                 html += '<div class="result-section">' +
@@ -664,6 +966,21 @@ document.addEventListener('DOMContentLoaded', function() {
                     (safeIP ? '<div class="result-row"><span class="result-label">Server</span><span class="result-value">' + safeIP + '</span></div>' : '') +
                 '</div>' +
                 '<p class="result-hint">You can safely start a new deployment. All steps are idempotent and will pick up where they left off.</p>';
+        } else if (status === 'cancelled') {
+            panel.innerHTML =
+                '<h3>' + warnSVG + ' Deployment Cancelled</h3>' +
+                '<div class="result-grid">' +
+                    '<div class="result-row">' +
+                        '<span class="result-label">Reason</span>' +
+                        '<span class="result-value">The deployment was cancelled before it completed.</span>' +
+                    '</div>' +
+                    (safeIP ? '<div class="result-row"><span class="result-label">Server</span><span class="result-value">' + safeIP + '</span></div>' : '') +
+                    '<div class="result-row">' +
+                        '<span class="result-label">Deploy Log</span>' +
+                        '<a href="' + escapeHtml(logDownloadURL) + '" class="result-download" download>Download Full Log</a>' +
+                    '</div>' +
+                '</div>' +
+                '<p class="result-hint">You can safely start a new deployment. All steps are idempotent and will pick up where they left off.</p>';
         } else {
             var errorLines = [];
             var allLines = logOutput.querySelectorAll('.log-line.error');
@@ -748,34 +1065,41 @@ document.addEventListener('DOMContentLoaded', function() {
     // --- Polling fallback (with auth) ---
 
     function pollStatus(deploymentId) {
+        // The stream delivered every line up to here; each poll returns one
+        // page from the cursor, so keep reading until it catches up
+        var cursor = rawLogLines.length;
         var interval = setInterval(async function() {
             try {
-                var response = await fetch('/api/deployments/' + deploymentId, {
-                    headers: { 'Authorization': 'Bearer ' + authToken }
-                });
+                var data;
+                do {
+                    var response = await fetch('/api/deployments/' + deploymentId + '?since=' + cursor, {
+                        headers: { 'X-CSRF-Token': csrfToken }
+                    });
 
-                if (response.status === 401) {
-                    clearInterval(interval);
-                    handleAuthFailure();
-                    return;
-                }
+                    if (response.status === 401) {
+                        clearInterval(interval);
+                        handleAuthFailure();
+                        return;
+                    }
 
-                var data = await response.json();
+                    data = await response.json();
+                    (data.logs || []).forEach(function(line) {
+                        rawLogLines.push(line);
+                        appendLog(line);
+                    });
+                    cursor = (data.log_start || 0) + (data.logs || []).length;
+                } while (data.logs && data.logs.length > 0 && cursor < data.log_count);
 
                 if (data.stages) {
                     updateAllStages(data.stages);
                 }
+                renderNodes(data.nodes);
 
-                logOutput.innerHTML = '';
-                if (data.logs) {
-                    data.logs.forEach(function(line) {
-                        appendLog(line);
-                    });
-                }
-
-                if (data.status === 'success' || data.status === 'failed' || data.status === 'interrupted') {
+                if (data.status === 'success' || data.status === 'failed' || data.status === 'interrupted' || data.status === 'cancelled') {
                     clearInterval(interval);
                     updateFinalStatus(data.status);
+                } else {
+                    updateRunStatus(data.status, data.queue_position);
                 }
             } catch (err) {
                 console.error('Poll failed:', err);
@@ -815,8 +1139,9 @@ document.addEventListener('DOMContentLoaded', function() {
 
     // --- Retry ---
 
+    // Resume the failed deployment from its failed stage (server reuses the original settings)
     window.retryDeployment = async function() {
-        if (!lastPayload) return;
+        if (!currentDeploymentId) return;
 
         retryBtn.disabled = true;
         retryBtn.textContent = 'Retrying...';
@@ -826,13 +1151,9 @@ document.addEventListener('DOMContentLoaded', function() {
         if (oldResult) oldResult.remove();
 
         try {
-            var response = await fetch('/api/deploy', {
+            var response = await fetch('/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/resume', {
                 method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                    'Authorization': 'Bearer ' + authToken
-                },
-                body: JSON.stringify(lastPayload)
+                headers: { 'X-CSRF-Token': csrfToken }
             });
 
             if (!response.ok) {
@@ -845,7 +1166,13 @@ document.addEventListener('DOMContentLoaded', function() {
             }
 
             var data = await response.json();
+            // Keep the original deployment's details (the form may be empty after a page reload)
+            var domain = currentDomain, serverIP = currentServerIP, csMode = currentCloudStackMode, deployType = currentDeployType;
             showDashboard(data.id, data.stages);
+            currentDomain = domain;
+            currentServerIP = serverIP;
+            currentCloudStackMode = csMode;
+            currentDeployType = deployType;
         } catch (err) {
             alert('Retry failed: ' + err.message);
         }
@@ -854,6 +1181,165 @@ document.addEventListener('DOMContentLoaded', function() {
         retryBtn.textContent = 'Retry Deployment';
     };
 
+    // --- Credentials ---
+
+    // Kept for this page only; the credentials token is never persisted
+    var credentialsToken = '';
+
+    function credentialRows(label, service) {
+        var html = '';
+        if (service.username) {
+            html += '<div class="result-row">' +
+                    '<span class="result-label">' + label + ' User</span>' +
+                    '<span class="result-value">' + escapeHtml(service.username) + '</span>' +
+                    makeCopyBtn(service.username) +
+                '</div>';
+        }
+        if (service.password) {
+            html += '<div class="result-row">' +
+                    '<span class="result-label">' + label + ' Password</span>' +
+                    makeSecretField(service.password) +
+                '</div>';
+        }
+        return html;
+    }
+
+    window.revealCredentials = async function() {
+        if (!currentDeploymentId) return;
+        if (!credentialsToken) {
+            credentialsToken = prompt('Credentials token (from credentials_token in the deployer data directory):') || '';
+            if (!credentialsToken) return;
+        }
+
+        try {
+            var response = await fetch('/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/credentials', {
+                headers: {
+                    'X-CSRF-Token': csrfToken,
+                    'X-Credentials-Token': credentialsToken
+                }
+            });
+            if (response.status === 401) {
+                handleAuthFailure();
+                return;
+            }
+            var data = await response.json();
+            if (!response.ok) {
+                if (response.status === 403) credentialsToken = '';
+                throw new Error(data.error || 'Could not load credentials');
+            }
+
+            var html = '<h4>Generated Credentials</h4><div class="result-grid">' +
+                credentialRows('MySQL', data.mysql) +
+                credentialRows('MongoDB', data.mongodb) +
+                credentialRows('RabbitMQ', data.rabbitmq);
+            if (data.cloudstack) {
+                html += credentialRows('CloudStack', data.cloudstack);
+                if (data.cloudstack.api_key) {
+                    html += '<div class="result-row">' +
+                            '<span class="result-label">API Key</span>' +
+                            makeSecretField(data.cloudstack.api_key, true) +
+                        '</div>';
+                }
+                if (data.cloudstack.secret_key) {
+                    html += '<div class="result-row">' +
+                            '<span class="result-label">Secret Key</span>' +
+                            makeSecretField(data.cloudstack.secret_key, true) +
+                        '</div>';
+                }
+            }
+            html += '</div>';
+            document.getElementById('credentials-section').innerHTML = html;
+        } catch (err) {
+            alert('Credentials: ' + err.message);
+        }
+    };
+
+    // --- Uninstall ---
+
+    window.toggleUninstall = function() {
+        uninstallPanel.classList.toggle('hidden');
+    };
+
+    // Run the uninstall playbook against the current deployment's server
+    window.uninstallDeployment = async function() {
+        if (!currentDeploymentId) return;
+
+        var options = {
+            delete_pvc: document.getElementById('uninstall_delete_pvc').checked,
+            delete_namespace: document.getElementById('uninstall_delete_namespace').checked,
+            delete_databases: document.getElementById('uninstall_delete_databases').checked,
+            remove_simulator: document.getElementById('uninstall_remove_simulator').checked
+        };
+        var warning = 'Uninstall StackBill from ' + currentServerIP + '?';
+        if (options.delete_pvc || options.delete_databases) {
+            warning += '\n\nStackBill data will be permanently deleted.';
+        }
+        if (!confirm(warning)) return;
+
+        var startBtn = document.getElementById('uninstall-start-btn');
+        startBtn.disabled = true;
+        startBtn.textContent = 'Starting...';
+
+        try {
+            var response = await postDeployRequest('/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/uninstall', options);
+
+            if (!response.ok) {
+                if (response.status === 401) {
+                    handleAuthFailure();
+                    return;
+                }
+                var err = await response.json();
+                throw new Error(err.error || 'Uninstall failed to start');
+            }
+
+            var data = await response.json();
+            // Keep the original deployment's details (the form may be empty after a page reload)
+            var domain = currentDomain, serverIP = currentServerIP;
+            showDashboard(data.id, data.stages);
+            currentDomain = domain;
+            currentServerIP = serverIP;
+            currentCloudStackMode = '';
+            currentDeployType = 'uninstall';
+            uninstallPanel.querySelectorAll('input[type="checkbox"]').forEach(function(box) {
+                box.checked = false;
+            });
+        } catch (err) {
+            alert('Uninstall failed: ' + err.message);
+        } finally {
+            startBtn.disabled = false;
+            startBtn.textContent = 'Start Uninstall';
+        }
+    };
+
+    window.cancelDeployment = async function() {
+        if (!currentDeploymentId) return;
+        if (!confirm('Cancel this deployment? The running step will be stopped immediately.')) return;
+
+        cancelBtn.disabled = true;
+        cancelBtn.textContent = 'Cancelling...';
+
+        try {
+            var response = await fetch('/api/deployments/' + encodeURIComponent(currentDeploymentId) + '/cancel', {
+                method: 'POST',
+                headers: { 'X-CSRF-Token': csrfToken }
+            });
+
+            if (!response.ok) {
+                if (response.status === 401) {
+                    handleAuthFailure();
+                    return;
+                }
+                var err = await response.json();
+                throw new Error(err.error || 'Cancel failed');
+            }
+        } catch (err) {
+            alert('Cancel failed: ' + err.message);
+        }
+
+        cancelBtn.disabled = false;
+        cancelBtn.textContent = 'Cancel Deployment';
+    };
+
     // --- Copy & Toggle ---
 
     window.copyValue = function(btn) {
@@ -904,9 +1390,17 @@ document.addEventListener('DOMContentLoaded', function() {
         appContainer.classList.remove('container-wide');
         newDeployBtn.classList.add('hidden');
         retryBtn.classList.add('hidden');
+        uninstallBtn.classList.add('hidden');
+        uninstallPanel.classList.add('hidden');
+        cancelBtn.classList.add('hidden');
         deployBtn.disabled = true;
         deployBtn.textContent = 'Deploy StackBill';
         form.reset();
+        document.getElementById('type_install').checked = true;
+        upgradeOptions.classList.add('hidden');
+        document.querySelectorAll('.install-only').forEach(function(section) {
+            section.classList.remove('hidden');
+        });
         document.getElementById('cloudstack_version').value = '4.21.0.0';
         document.getElementById('ssl_letsencrypt').checked = true;
         sslLetsencryptOptions.classList.remove('hidden');
@@ -922,7 +1416,18 @@ document.addEventListener('DOMContentLoaded', function() {
         var keyLabel = sslKeyInput.previousElementSibling;
         if (certLabel) certLabel.classList.remove('has-file');
         if (keyLabel) keyLabel.classList.remove('has-file');
-        lastPayload = null;
+        document.getElementById('ssh_auth_password').checked = true;
+        sshKeyOptions.classList.add('hidden');
+        sshPassLabel.textContent = 'SSH Password';
+        sshKeyContent = '';
+        document.getElementById('ssh_key_name').textContent = fileUploadPlaceholders.ssh_key_name;
+        var sshKeyLabel = sshKeyInput.previousElementSibling;
+        if (sshKeyLabel) sshKeyLabel.classList.remove('has-file');
+        nodeRows.innerHTML = '';
+        preflightPassed = false;
+        preflightReport.innerHTML = '';
+        preflightReport.classList.add('hidden');
+        preflightBtn.disabled = true;
         initFloatingLabels();
     };
 });